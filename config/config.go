@@ -5,6 +5,7 @@ import (
 	"github.com/joho/godotenv"
 	"log"
 	"os"
+	"time"
 )
 
 type Config struct {
@@ -13,17 +14,50 @@ type Config struct {
 	HTTPServer    `yaml:"http_server"`
 }
 
+// Modes of the storage
+const (
+	StorageMemory   = "memory"
+	StoragePostgres = "postgres"
+	StorageSQLite   = "sqlite"
+)
+
 type StorageConfig struct {
-	Username string `yaml:"username" env-required:"true"`
-	Password string `yaml:"password" env-required:"true"`
-	DBHost   string `yaml:"host" env-required:"true"`
-	DBPort   string `yaml:"port" env-required:"true"`
-	Database string `yaml:"database" env-required:"true"`
+	Mode       string `yaml:"mode" env-default:"memory"`
+	SQLitePath string `yaml:"sqlite_path" env-default:"myhabr.db"`
+	// Replies deeper than MaxCommentDepth are rejected in every mode, zero means no limit
+	MaxCommentDepth int32 `yaml:"max_comment_depth" env-default:"32"`
+	// Cache of memory mode is persistent if CacheDir is set
+	CacheDir              string        `yaml:"cache_dir"`
+	CacheFsync            string        `yaml:"cache_fsync" env-default:"interval"`
+	CacheFsyncInterval    time.Duration `yaml:"cache_fsync_interval" env-default:"1s"`
+	CacheSnapshotInterval time.Duration `yaml:"cache_snapshot_interval" env-default:"5m"`
+	// Oldest posts of memory mode are evicted over the limits, zero means no limit
+	CacheMaxEntries int   `yaml:"cache_max_entries"`
+	CacheMaxBytes   int64 `yaml:"cache_max_bytes"`
+	// Posts read from postgres are kept in memory if ReadCacheTTL and ReadCacheSize are set
+	ReadCacheTTL  time.Duration `yaml:"read_cache_ttl" env-default:"30s"`
+	ReadCacheSize int           `yaml:"read_cache_size" env-default:"1000"`
+	Username      string        `yaml:"username" env-required:"true"`
+	Password      string        `yaml:"password" env-required:"true"`
+	DBHost        string        `yaml:"host" env-required:"true"`
+	DBPort        string        `yaml:"port" env-required:"true"`
+	Database      string        `yaml:"database" env-required:"true"`
+	// Pool limits are applied to the primary and to every replica
+	PoolMaxConns        int32         `yaml:"pool_max_conns" env-default:"10"`
+	PoolMaxConnLifetime time.Duration `yaml:"pool_max_conn_lifetime" env-default:"1h30m"`
+	// Replicas are connection strings of read replicas, posts are read from the healthy ones
+	Replicas             []string      `yaml:"replicas"`
+	ReplicaCheckInterval time.Duration `yaml:"replica_check_interval" env-default:"5s"`
+	// Posts read within ReplicaLag after a write aren't cached, as replicas may not have the write yet
+	ReplicaLag time.Duration `yaml:"replica_lag" env-default:"1s"`
 }
 
 type HTTPServer struct {
-	ServerHost string `yaml:"host" env-default:"localhost"`
-	ServerPort string `yaml:"port" env-default:"8080"`
+	ServerHost       string        `yaml:"host" env-default:"localhost"`
+	ServerPort       string        `yaml:"port" env-default:"8080"`
+	OperationTimeout time.Duration `yaml:"operation_timeout" env-default:"10s"`
+	// Websocket connections are accepted from the host of the server and from AllowedOrigins
+	AllowedOrigins []string `yaml:"allowed_origins"`
 }
 
 func MustLoad() *Config {
@@ -0,0 +1,52 @@
+package globalid
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Type is a type of the entity the id belongs to
+type Type string
+
+const (
+	User    Type = "User"
+	Post    Type = "Post"
+	Comment Type = "Comment"
+)
+
+// Encode returns opaque id of the entity, it is base64 of "Type:key"
+func Encode(t Type, key int64) string {
+	return base64.URLEncoding.EncodeToString([]byte(string(t) + ":" + strconv.FormatInt(key, 10)))
+}
+
+// Decode returns key of the entity from its id,
+// or returns error if id is not the one returned by Encode for the type
+func Decode(t Type, id string) (int64, error) {
+	raw, err := base64.URLEncoding.DecodeString(id)
+	if err != nil {
+		return 0, fmt.Errorf("ID: %v is invalid", id)
+	}
+	typ, value, ok := strings.Cut(string(raw), ":")
+	if !ok || Type(typ) != t {
+		return 0, fmt.Errorf("ID: %v is not a %s id", id, strings.ToLower(string(t)))
+	}
+	key, err := strconv.ParseInt(value, 10, 64)
+	// Only the canonical form is accepted, so every entity has exactly one id
+	if err != nil || key <= 0 || Encode(t, key) != id {
+		return 0, fmt.Errorf("ID: %v is invalid", id)
+	}
+	return key, nil
+}
+
+// DecodeAll returns keys of ids of the type, invalid ids are skipped
+func DecodeAll(t Type, ids []string) []int64 {
+	keys := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if key, err := Decode(t, id); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
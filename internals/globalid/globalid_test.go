@@ -0,0 +1,62 @@
+package globalid_test
+
+import (
+	"encoding/base64"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/globalid"
+	"slices"
+	"testing"
+)
+
+func encode(raw string) string {
+	return base64.URLEncoding.EncodeToString([]byte(raw))
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, typ := range []globalid.Type{globalid.User, globalid.Post, globalid.Comment} {
+		for _, key := range []int64{1, 42, 1 << 62} {
+			id := globalid.Encode(typ, key)
+			got, err := globalid.Decode(typ, id)
+			if err != nil || got != key {
+				t.Errorf("Decode(%v, %v) returned %v, error: %v, want %v", typ, id, got, err, key)
+			}
+		}
+	}
+	if id := globalid.Encode(globalid.Post, 1); id != encode("Post:1") {
+		t.Errorf("Encode returned %v, want base64 of Post:1", id)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+	}{
+		{"wrong type", globalid.Encode(globalid.Comment, 1)},
+		{"unknown type", encode("Vote:1")},
+		{"bad base64", "UG9zdDox!"},
+		{"raw key", "1"},
+		{"missing colon", encode("Post1")},
+		{"empty key", encode("Post:")},
+		{"empty id", ""},
+		{"not a number", encode("Post:one")},
+		{"zero key", encode("Post:0")},
+		{"negative key", encode("Post:-1")},
+		{"not canonical", encode("Post:01")},
+		{"lower case type", encode("post:1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if key, err := globalid.Decode(globalid.Post, tt.id); err == nil {
+				t.Errorf("Decode(%q) returned %v, want error", tt.id, key)
+			}
+		})
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	ids := []string{globalid.Encode(globalid.Post, 2), "invalid", globalid.Encode(globalid.User, 3),
+		globalid.Encode(globalid.Post, 1)}
+	if got, want := globalid.DecodeAll(globalid.Post, ids), []int64{2, 1}; !slices.Equal(got, want) {
+		t.Errorf("DecodeAll returned %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// Codes of errors set in extensions.code
+const (
+	CodeNotFound         = "NOT_FOUND"
+	CodeConflict         = "CONFLICT"
+	CodeValidation       = "VALIDATION"
+	CodeForbidden        = "FORBIDDEN"
+	CodeCommentsDisabled = "COMMENTS_DISABLED"
+	CodeDeadlineExceeded = "DEADLINE_EXCEEDED"
+	CodeCanceled         = "CANCELED"
+	CodeInternal         = "INTERNAL"
+)
+
+const internalErrorMessage = "internal error"
+
+// errorCodes maps kinds of storage errors to their codes
+var errorCodes = []struct {
+	kind error
+	code string
+}{
+	{storage.ErrNotFound, CodeNotFound},
+	{storage.ErrConflict, CodeConflict},
+	{storage.ErrValidation, CodeValidation},
+	{storage.ErrForbidden, CodeForbidden},
+	{storage.ErrCommentsDisabled, CodeCommentsDisabled},
+	{storage.ErrDeadlineExceeded, CodeDeadlineExceeded},
+	{storage.ErrCanceled, CodeCanceled},
+	{storage.ErrInternal, CodeInternal},
+}
+
+// ErrorPresenter sets extensions.code of storage errors and errors of the context, message of internal errors
+// is replaced, so details of the storage don't leak to clients. Other errors are presented as usual.
+func ErrorPresenter(ctx context.Context, err error) *gqlerror.Error {
+	gqlErr := graphql.DefaultErrorPresenter(ctx, err)
+
+	code := errorCode(err)
+	if code == "" {
+		return gqlErr
+	}
+	if code == CodeInternal {
+		gqlErr.Message = internalErrorMessage
+	}
+	if gqlErr.Extensions == nil {
+		gqlErr.Extensions = map[string]interface{}{}
+	}
+	gqlErr.Extensions["code"] = code
+	return gqlErr
+}
+
+// errorCode returns code of the error, or empty string if the error has no code
+func errorCode(err error) string {
+	var storageErr *storage.Error
+	if errors.As(err, &storageErr) {
+		for _, c := range errorCodes {
+			if errors.Is(storageErr.Kind, c.kind) {
+				return c.code
+			}
+		}
+	}
+	// Loaders return errors of the context as they are
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return CodeCanceled
+	}
+	return ""
+}
@@ -0,0 +1,56 @@
+package graph_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"testing"
+)
+
+func TestErrorPresenter(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		code    string
+		message string
+	}{
+		{"not found", storage.NewError(storage.ErrNotFound, "Post: 1 doesn't exist"), graph.CodeNotFound,
+			"Post: 1 doesn't exist"},
+		{"conflict", storage.NewError(storage.ErrConflict, "User: alice already exists"), graph.CodeConflict,
+			"User: alice already exists"},
+		{"validation", storage.NewError(storage.ErrValidation, "Comment is empty"), graph.CodeValidation,
+			"Comment is empty"},
+		{"forbidden", storage.NewError(storage.ErrForbidden, "not the author"), graph.CodeForbidden, "not the author"},
+		{"comments disabled", storage.NewError(storage.ErrCommentsDisabled, "comments are closed"),
+			graph.CodeCommentsDisabled, "comments are closed"},
+		{"deadline", storage.NewError(storage.ErrDeadlineExceeded, "too slow"), graph.CodeDeadlineExceeded, "too slow"},
+		{"canceled", storage.NewError(storage.ErrCanceled, "client left"), graph.CodeCanceled, "client left"},
+		{"internal", storage.NewError(storage.ErrInternal, "unable to connect to 10.0.0.1:5432"), graph.CodeInternal,
+			"internal error"},
+		{"wrapped", fmt.Errorf("resolver: %w", storage.NewError(storage.ErrNotFound, "Comment: 2 doesn't exist")),
+			graph.CodeNotFound, "resolver: Comment: 2 doesn't exist"},
+		{"context deadline", context.DeadlineExceeded, graph.CodeDeadlineExceeded, context.DeadlineExceeded.Error()},
+		{"context canceled", context.Canceled, graph.CodeCanceled, context.Canceled.Error()},
+		{"other", errors.New("unknown argument"), "", "unknown argument"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gqlErr := graph.ErrorPresenter(context.Background(), tt.err)
+			if gqlErr.Message != tt.message {
+				t.Errorf("ErrorPresenter returned message %q, want %q", gqlErr.Message, tt.message)
+			}
+			code, ok := gqlErr.Extensions["code"]
+			if tt.code == "" {
+				if ok {
+					t.Errorf("ErrorPresenter returned code %v for error without code", code)
+				}
+				return
+			}
+			if code != tt.code {
+				t.Errorf("ErrorPresenter returned code %v, want %v", code, tt.code)
+			}
+		})
+	}
+}
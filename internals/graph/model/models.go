@@ -0,0 +1,52 @@
+package model
+
+import "time"
+
+// Post is bound to the Post type of the schema. Comments keeps top level comments of the post,
+// they are returned to clients page by page by the Post.comments resolver.
+// CommentsLoaded is set when Comments is a preloaded tree, that can be paged without storage.
+type Post struct {
+	ID                   string     `json:"id"`
+	UserID               string     `json:"userId"`
+	Title                string     `json:"title"`
+	Text                 string     `json:"text"`
+	Comments             []*Comment `json:"-"`
+	CommentsLoaded       bool       `json:"-"`
+	AllowComments        bool       `json:"allowComments"`
+	CommentsClosedAt     *time.Time `json:"commentsClosedAt,omitempty"`
+	CommentsClosedReason *string    `json:"commentsClosedReason,omitempty"`
+	CreatedAt            time.Time  `json:"createdAt"`
+	UpdatedAt            time.Time  `json:"updatedAt"`
+}
+
+// Comment is bound to the Comment type of the schema. Children keeps replies to the comment,
+// they are returned to clients page by page by the Comment.children resolver.
+// ChildrenLoaded is set when Children are preloaded, Cursor is the cursor of the comment among its siblings.
+// Deleted comments that have replies stay in the tree with DeletedCommentText.
+// Upvotes and Downvotes count votes of users for the comment, its score is their difference.
+// Depth is the level of the comment in the tree, top level comments have depth 1.
+type Comment struct {
+	ID             string     `json:"id"`
+	UserID         string     `json:"userId"`
+	PostID         string     `json:"postId"`
+	ParentID       string     `json:"parentId"`
+	Text           string     `json:"text"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+	Children       []*Comment `json:"-"`
+	ChildrenLoaded bool       `json:"-"`
+	ChildrenCount  int32      `json:"childrenCount"`
+	Deleted        bool       `json:"deleted"`
+	Depth          int32      `json:"depth"`
+	Upvotes        int32      `json:"upvotes"`
+	Downvotes      int32      `json:"downvotes"`
+	Cursor         string     `json:"-"`
+}
+
+// Score is the number of upvotes minus the number of downvotes of the comment
+func (c *Comment) Score() int32 {
+	return c.Upvotes - c.Downvotes
+}
+
+// DeletedCommentText replaces the text of deleted comments
+const DeletedCommentText = "[deleted]"
@@ -0,0 +1,16 @@
+package graph
+
+import (
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/loaders"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"time"
+)
+
+// AroundOperations adds middlewares of operations to srv. The first one added is the outermost,
+// so loaders get the deadline and the session of the operation and read its own writes.
+func AroundOperations(srv *handler.Server, store storage.Storage, timeout time.Duration) {
+	srv.AroundOperations(OperationTimeout(timeout))
+	srv.AroundOperations(Session)
+	srv.AroundOperations(loaders.Middleware(store))
+}
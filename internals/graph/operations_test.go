@@ -0,0 +1,106 @@
+package graph_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessionStorage marks the session on writes, as sql storages do, and records if reads see it
+type sessionStorage struct {
+	storage.Storage
+
+	m     sync.Mutex
+	reads map[string]bool
+}
+
+func (s *sessionStorage) read(ctx context.Context, method string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.reads[method] = storage.HasWritten(ctx)
+}
+
+func (s *sessionStorage) AddComment(ctx context.Context, userId, postId, parentId, text string) (*model.Comment, error) {
+	storage.MarkWritten(ctx)
+	return s.Storage.AddComment(ctx, userId, postId, parentId, text)
+}
+
+func (s *sessionStorage) GetComments(ctx context.Context, commentIds []string) (map[string]*model.Comment, error) {
+	s.read(ctx, "GetComments")
+	return s.Storage.GetComments(ctx, commentIds)
+}
+
+func (s *sessionStorage) GetAncestorsByComments(ctx context.Context, commentIds []string) (map[string][]*model.Comment, error) {
+	s.read(ctx, "GetAncestorsByComments")
+	return s.Storage.GetAncestorsByComments(ctx, commentIds)
+}
+
+func (s *sessionStorage) GetChildrenByComments(ctx context.Context, commentIds []string, page storage.Page) (map[string]*model.CommentConnection, error) {
+	s.read(ctx, "GetChildrenByComments")
+	return s.Storage.GetChildrenByComments(ctx, commentIds, page)
+}
+
+func TestMutationReadsItsWrites(t *testing.T) {
+	ctx := context.Background()
+	cache := storage.NewCache()
+	alice, err := cache.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	post, err := cache.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	top, err := cache.AddComment(ctx, alice.ID, post.ID, post.ID, "text")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+
+	store := &sessionStorage{Storage: cache, reads: make(map[string]bool)}
+	srv := handler.New(graph.NewExecutableSchema(graph.Config{Resolvers: &graph.Resolver{
+		Storage: store,
+		Log:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}}))
+	srv.AddTransport(transport.POST{})
+	graph.AroundOperations(srv, store, time.Second)
+
+	// Nested fields of the mutation result are loaded in batches after the write
+	query := fmt.Sprintf(`mutation { createComment(userId: %q, postId: %q, parentId: %q, text: "reply") {
+		parent { id } ancestors { id } children { totalCount } } }`, alice.ID, post.ID, top.ID)
+	body, err := json.Marshal(map[string]string{"query": query})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	var resp struct {
+		Errors []json.RawMessage `json:"errors"`
+	}
+	if err = json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Errors) > 0 {
+		t.Fatalf("createComment returned %s, error: %v", rec.Body.String(), err)
+	}
+	for _, method := range []string{"GetComments", "GetAncestorsByComments", "GetChildrenByComments"} {
+		written, ok := store.reads[method]
+		if !ok {
+			t.Errorf("%v is not called", method)
+		} else if !written {
+			t.Errorf("%v doesn't see the write of the operation", method)
+		}
+	}
+}
@@ -9,6 +9,9 @@ import (
 //
 // It serves as dependency injection for your app, add any dependencies you require here.
 
+// maxCommentWindow bounds maxDepth of the post and comment queries
+const maxCommentWindow = 10
+
 type Resolver struct {
 	Storage storage.Storage
 	Log     *slog.Logger
@@ -6,13 +6,64 @@ package graph
 
 import (
 	"context"
-	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
 	"log/slog"
+
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/loaders"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
 )
 
+// Children is the resolver for the children field.
+func (r *commentResolver) Children(ctx context.Context, obj *model.Comment, first *int32, after *string, sort *model.CommentSort) (*model.CommentConnection, error) {
+	key := loaders.NewPageKey(obj.ID, first, after, sort)
+	if obj.ChildrenLoaded {
+		return storage.PageComments(obj.Children, key.Page())
+	}
+	children, err := loaders.For(ctx).ChildrenByComment.Load(ctx, key)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	return children, nil
+}
+
+// ViewerVote is the resolver for the viewerVote field.
+func (r *commentResolver) ViewerVote(ctx context.Context, obj *model.Comment, userID string) (model.VoteValue, error) {
+	vote, err := loaders.For(ctx).VotesByUser.Load(ctx, loaders.VoteKey{UserID: userID, CommentID: obj.ID})
+	if err != nil {
+		r.Log.Error(err.Error())
+		return "", err
+	}
+	return vote, nil
+}
+
+// Parent is the resolver for the parent field.
+func (r *commentResolver) Parent(ctx context.Context, obj *model.Comment) (*model.Comment, error) {
+	// Parent of top level comments is the post
+	if obj.ParentID == obj.PostID {
+		return nil, nil
+	}
+	parent, err := loaders.For(ctx).Comments.Load(ctx, obj.ParentID)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	return parent, nil
+}
+
+// Ancestors is the resolver for the ancestors field.
+func (r *commentResolver) Ancestors(ctx context.Context, obj *model.Comment) ([]*model.Comment, error) {
+	ancestors, err := loaders.For(ctx).AncestorsByComment.Load(ctx, obj.ID)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	return ancestors, nil
+}
+
 // CreateUser is the resolver for the createUser field.
 func (r *mutationResolver) CreateUser(ctx context.Context, username string, email string) (*model.User, error) {
-	user, err := r.Storage.AddUser(username, email)
+	user, err := r.Storage.AddUser(ctx, username, email)
 	if err != nil {
 		r.Log.Error(err.Error())
 		return nil, err
@@ -23,7 +74,7 @@ func (r *mutationResolver) CreateUser(ctx context.Context, username string, emai
 
 // CreatePost is the resolver for the createPost field.
 func (r *mutationResolver) CreatePost(ctx context.Context, userID string, title string, text string, allowComments bool) (*model.Post, error) {
-	post, err := r.Storage.AddPost(userID, title, text, allowComments)
+	post, err := r.Storage.AddPost(ctx, userID, title, text, allowComments)
 	if err != nil {
 		r.Log.Error(err.Error())
 		return nil, err
@@ -34,7 +85,7 @@ func (r *mutationResolver) CreatePost(ctx context.Context, userID string, title
 
 // CreateComment is the resolver for the createComment field.
 func (r *mutationResolver) CreateComment(ctx context.Context, userID string, postID string, parentID string, text string) (*model.Comment, error) {
-	comment, err := r.Storage.AddComment(userID, postID, parentID, text)
+	comment, err := r.Storage.AddComment(ctx, userID, postID, parentID, text)
 	if err != nil {
 		r.Log.Error(err.Error())
 		return nil, err
@@ -43,21 +94,112 @@ func (r *mutationResolver) CreateComment(ctx context.Context, userID string, pos
 	return comment, nil
 }
 
+// UpdatePost is the resolver for the updatePost field.
+func (r *mutationResolver) UpdatePost(ctx context.Context, userID string, id string, title *string, text *string) (*model.Post, error) {
+	post, err := r.Storage.UpdatePost(ctx, userID, id, title, text)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	r.Log.Debug("Post is successfully updated", slog.String("post", post.Title), slog.String("post id", post.ID))
+	return post, nil
+}
+
+// DeletePost is the resolver for the deletePost field.
+func (r *mutationResolver) DeletePost(ctx context.Context, userID string, id string) (bool, error) {
+	err := r.Storage.DeletePost(ctx, userID, id)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return false, err
+	}
+	r.Log.Debug("Post is successfully deleted", slog.String("post id", id))
+	return true, nil
+}
+
+// UpdateComment is the resolver for the updateComment field.
+func (r *mutationResolver) UpdateComment(ctx context.Context, userID string, id string, text string) (*model.Comment, error) {
+	comment, err := r.Storage.UpdateComment(ctx, userID, id, text)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	r.Log.Debug("Comment is successfully updated", slog.String("comment", comment.Text), slog.String("comment id", comment.ID))
+	return comment, nil
+}
+
+// DeleteComment is the resolver for the deleteComment field.
+func (r *mutationResolver) DeleteComment(ctx context.Context, userID string, id string) (bool, error) {
+	err := r.Storage.DeleteComment(ctx, userID, id)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return false, err
+	}
+	r.Log.Debug("Comment is successfully deleted", slog.String("comment id", id))
+	return true, nil
+}
+
+// SetCommentsAllowed is the resolver for the setCommentsAllowed field.
+func (r *mutationResolver) SetCommentsAllowed(ctx context.Context, userID string, postID string, allowed bool, reason *string) (*model.Post, error) {
+	post, err := r.Storage.SetCommentsAllowed(ctx, userID, postID, allowed, reason)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	r.Log.Debug("Comments permission is successfully changed", slog.String("post id", post.ID),
+		slog.Bool("allowed", post.AllowComments))
+	return post, nil
+}
+
+// VoteComment is the resolver for the voteComment field.
+func (r *mutationResolver) VoteComment(ctx context.Context, userID string, commentID string, value model.VoteValue) (*model.Comment, error) {
+	comment, err := r.Storage.VoteComment(ctx, userID, commentID, value)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	r.Log.Debug("Comment is successfully voted", slog.String("comment id", comment.ID),
+		slog.String("vote", value.String()))
+	return comment, nil
+}
+
+// Comments is the resolver for the comments field.
+func (r *postResolver) Comments(ctx context.Context, obj *model.Post, first *int32, after *string, sort *model.CommentSort) (*model.CommentConnection, error) {
+	key := loaders.NewPageKey(obj.ID, first, after, sort)
+	if obj.CommentsLoaded {
+		return storage.PageComments(obj.Comments, key.Page())
+	}
+	comments, err := loaders.For(ctx).CommentsByPost.Load(ctx, key)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	return comments, nil
+}
+
 // Posts is the resolver for the posts field.
-func (r *queryResolver) Posts(ctx context.Context) ([]*model.Post, error) {
-	posts, err := r.Storage.GetAllPosts()
+func (r *queryResolver) Posts(ctx context.Context, first *int32, after *string, last *int32, before *string) (*model.PostConnection, error) {
+	posts, err := r.Storage.GetPosts(ctx, storage.Page{First: first, After: after, Last: last, Before: before})
 	if err != nil {
 		r.Log.Error(err.Error())
 		return nil, err
 	}
-	r.Log.Debug("Posts are successfully returned")
+	r.Log.Debug("Posts are successfully returned", slog.Int("count", len(posts.Edges)))
 	return posts, nil
 }
 
 // Post is the resolver for the post field.
-func (r *queryResolver) Post(ctx context.Context, id string) (*model.Post, error) {
+func (r *queryResolver) Post(ctx context.Context, id string, maxDepth *int32) (*model.Post, error) {
+	// Without maxDepth comments are loaded lazily, level by level
+	var depth int32
+	if maxDepth != nil {
+		if *maxDepth < 0 || *maxDepth > maxCommentWindow {
+			return nil, storage.NewError(storage.ErrValidation, "maxDepth: %v should be from 0 to %v", *maxDepth,
+				maxCommentWindow)
+		}
+		depth = *maxDepth
+	}
 
-	post, err := r.Storage.GetPost(id)
+	post, err := r.Storage.GetPost(ctx, id, depth)
 	if err != nil {
 		r.Log.Error(err.Error())
 		return nil, err
@@ -66,11 +208,102 @@ func (r *queryResolver) Post(ctx context.Context, id string) (*model.Post, error
 	return post, nil
 }
 
+// Comment is the resolver for the comment field.
+func (r *queryResolver) Comment(ctx context.Context, id string, maxDepth *int32) (*model.Comment, error) {
+	// Replies below the window are loaded lazily by children
+	var depth int32
+	if maxDepth != nil {
+		if *maxDepth < 0 || *maxDepth > maxCommentWindow {
+			return nil, storage.NewError(storage.ErrValidation, "maxDepth: %v should be from 0 to %v", *maxDepth,
+				maxCommentWindow)
+		}
+		depth = *maxDepth
+	}
+
+	comment, err := r.Storage.GetComment(ctx, id, depth)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	r.Log.Debug("Comment is successfully returned", slog.String("comment id", comment.ID))
+	return comment, nil
+}
+
+// User is the resolver for the user field.
+func (r *queryResolver) User(ctx context.Context, id string) (*model.User, error) {
+	user, err := r.Storage.GetUser(ctx, id)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	r.Log.Debug("User is successfully returned", slog.String("user", user.Username), slog.String("user id", user.ID))
+	return user, nil
+}
+
+// UserByUsername is the resolver for the userByUsername field.
+func (r *queryResolver) UserByUsername(ctx context.Context, username string) (*model.User, error) {
+	user, err := r.Storage.GetUserByUsername(ctx, username)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	r.Log.Debug("User is successfully returned", slog.String("user", user.Username), slog.String("user id", user.ID))
+	return user, nil
+}
+
+// Users is the resolver for the users field.
+func (r *queryResolver) Users(ctx context.Context) ([]*model.User, error) {
+	users, err := r.Storage.GetUsers(ctx)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	r.Log.Debug("Users are successfully returned", slog.Int("count", len(users)))
+	return users, nil
+}
+
+// CommentAdded is the resolver for the commentAdded field.
+func (r *subscriptionResolver) CommentAdded(ctx context.Context, postID string) (<-chan *model.Comment, error) {
+	comments, err := r.Storage.SubscribeComments(ctx, postID)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	r.Log.Debug("Subscribed to new comments", slog.String("post id", postID))
+	return comments, nil
+}
+
+// Posts is the resolver for the posts field.
+func (r *userResolver) Posts(ctx context.Context, obj *model.User) ([]*model.Post, error) {
+	posts, err := loaders.For(ctx).PostsByUser.Load(ctx, obj.ID)
+	if err != nil {
+		r.Log.Error(err.Error())
+		return nil, err
+	}
+	return posts, nil
+}
+
+// Comment returns CommentResolver implementation.
+func (r *Resolver) Comment() CommentResolver { return &commentResolver{r} }
+
 // Mutation returns MutationResolver implementation.
 func (r *Resolver) Mutation() MutationResolver { return &mutationResolver{r} }
 
+// Post returns PostResolver implementation.
+func (r *Resolver) Post() PostResolver { return &postResolver{r} }
+
 // Query returns QueryResolver implementation.
 func (r *Resolver) Query() QueryResolver { return &queryResolver{r} }
 
+// Subscription returns SubscriptionResolver implementation.
+func (r *Resolver) Subscription() SubscriptionResolver { return &subscriptionResolver{r} }
+
+// User returns UserResolver implementation.
+func (r *Resolver) User() UserResolver { return &userResolver{r} }
+
+type commentResolver struct{ *Resolver }
 type mutationResolver struct{ *Resolver }
+type postResolver struct{ *Resolver }
 type queryResolver struct{ *Resolver }
+type subscriptionResolver struct{ *Resolver }
+type userResolver struct{ *Resolver }
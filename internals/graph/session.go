@@ -0,0 +1,12 @@
+package graph
+
+import (
+	"context"
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+)
+
+// Session starts a storage session for every operation, so reads of the operation after its mutation see it
+func Session(ctx context.Context, next graphql.OperationHandler) graphql.ResponseHandler {
+	return next(storage.WithSession(ctx))
+}
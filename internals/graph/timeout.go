@@ -0,0 +1,28 @@
+package graph
+
+import (
+	"context"
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/ast"
+	"time"
+)
+
+// OperationTimeout sets deadline for queries and mutations, subscriptions live until the client leaves
+func OperationTimeout(timeout time.Duration) graphql.OperationMiddleware {
+	return func(ctx context.Context, next graphql.OperationHandler) graphql.ResponseHandler {
+		if timeout <= 0 || graphql.GetOperationContext(ctx).Operation.Operation == ast.Subscription {
+			return next(ctx)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		responses := next(ctx)
+		return func(ctx context.Context) *graphql.Response {
+			resp := responses(ctx)
+			// Deferred fragments come with the next responses
+			if resp == nil || resp.HasNext == nil || !*resp.HasNext {
+				cancel()
+			}
+			return resp
+		}
+	}
+}
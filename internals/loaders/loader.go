@@ -0,0 +1,103 @@
+package loaders
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Loader collects keys requested during wait and fetches all of them with one call
+type Loader[K comparable, V any] struct {
+	// ctx is the context of the operation, batches are fetched with its values and deadline
+	ctx   context.Context
+	fetch func(ctx context.Context, keys []K) (map[K]V, error)
+	wait  time.Duration
+	batch *batch[K, V]
+	m     sync.Mutex
+}
+
+// batch is a set of keys fetched together
+type batch[K comparable, V any] struct {
+	keys   []K
+	seen   map[K]struct{}
+	values map[K]V
+	err    error
+	done   chan struct{}
+}
+
+// KeyErrors are errors of some keys of a batch, fetch returns them with values of the other keys,
+// so only the keys that failed get an error
+type KeyErrors[K comparable] map[K]error
+
+func (e KeyErrors[K]) Error() string {
+	for _, err := range e {
+		return err.Error()
+	}
+	return "no errors"
+}
+
+// NewLoader creates a new loader instance for the operation with ctx
+func NewLoader[K comparable, V any](ctx context.Context, wait time.Duration,
+	fetch func(ctx context.Context, keys []K) (map[K]V, error)) *Loader[K, V] {
+	return &Loader[K, V]{
+		ctx:   ctx,
+		fetch: fetch,
+		wait:  wait,
+	}
+}
+
+// Load adds key to the current batch and returns its value when the batch is fetched
+func (l *Loader[K, V]) Load(ctx context.Context, key K) (V, error) {
+	l.m.Lock()
+	b := l.batch
+	if b == nil {
+		// The first key of a batch starts the timer, keys that come before it fires are fetched together
+		b = &batch[K, V]{
+			seen: make(map[K]struct{}),
+			done: make(chan struct{}),
+		}
+		l.batch = b
+		time.AfterFunc(l.wait, func() {
+			l.run(b)
+		})
+	}
+	if _, ok := b.seen[key]; !ok {
+		b.seen[key] = struct{}{}
+		b.keys = append(b.keys, key)
+	}
+	l.m.Unlock()
+
+	var zero V
+	select {
+	case <-b.done:
+		if errs, ok := b.err.(KeyErrors[K]); ok {
+			if err := errs[key]; err != nil {
+				return zero, err
+			}
+		} else if b.err != nil {
+			return zero, b.err
+		}
+		return b.values[key], nil
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+// run closes the batch for new keys and fetches it. The batch is shared by fields of the operation,
+// so a field that is cancelled doesn't cancel it, only the deadline of the operation bounds it.
+func (l *Loader[K, V]) run(b *batch[K, V]) {
+	l.m.Lock()
+	if l.batch == b {
+		l.batch = nil
+	}
+	l.m.Unlock()
+
+	ctx := context.WithoutCancel(l.ctx)
+	if deadline, ok := l.ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	b.values, b.err = l.fetch(ctx, b.keys)
+	close(b.done)
+}
@@ -0,0 +1,139 @@
+package loaders_test
+
+import (
+	"context"
+	"errors"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/loaders"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+const wait = 20 * time.Millisecond
+
+// fetcher records keys of every fetch, and fails keys listed in errs
+type fetcher struct {
+	m       sync.Mutex
+	batches [][]string
+	err     error
+	errs    loaders.KeyErrors[string]
+}
+
+func (f *fetcher) fetch(_ context.Context, keys []string) (map[string]string, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.batches = append(f.batches, slices.Sorted(slices.Values(keys)))
+	if f.err != nil {
+		return nil, f.err
+	}
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if key != "missing" && f.errs[key] == nil {
+			values[key] = "value of " + key
+		}
+	}
+	if len(f.errs) > 0 {
+		return values, f.errs
+	}
+	return values, nil
+}
+
+// loadAll loads keys concurrently and returns their values and errors
+func loadAll(l *loaders.Loader[string, string], keys ...string) ([]string, []error) {
+	values := make([]string, len(keys))
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			values[i], errs[i] = l.Load(context.Background(), key)
+		}()
+	}
+	wg.Wait()
+	return values, errs
+}
+
+func TestLoaderBatch(t *testing.T) {
+	f := &fetcher{}
+	l := loaders.NewLoader(context.Background(), wait, f.fetch)
+
+	// Keys loaded together are fetched with one call, each key once
+	values, errs := loadAll(l, "a", "b", "a", "missing")
+	if want := [][]string{{"a", "b", "missing"}}; !slices.EqualFunc(f.batches, want, slices.Equal) {
+		t.Fatalf("keys are fetched in batches %v, want %v", f.batches, want)
+	}
+	if want := []string{"value of a", "value of b", "value of a", ""}; !slices.Equal(values, want) {
+		t.Errorf("Load returned %q, want %q", values, want)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("Load of key %v returned error: %v", i, err)
+		}
+	}
+
+	// Key loaded after the batch is fetched goes to the next one
+	if value, err := l.Load(context.Background(), "a"); err != nil || value != "value of a" {
+		t.Errorf("Load after the batch returned %q, error: %v", value, err)
+	}
+	if len(f.batches) != 2 {
+		t.Errorf("keys are fetched in %v batches, want 2", len(f.batches))
+	}
+}
+
+func TestLoaderErrors(t *testing.T) {
+	errFetch := errors.New("fetch failed")
+	f := &fetcher{err: errFetch}
+	l := loaders.NewLoader(context.Background(), wait, f.fetch)
+
+	// Error of the batch is returned for every key of it
+	_, errs := loadAll(l, "a", "b")
+	for i, err := range errs {
+		if !errors.Is(err, errFetch) {
+			t.Errorf("Load of key %v returned error: %v, want %v", i, err, errFetch)
+		}
+	}
+
+	// Errors of keys are returned only for them
+	errKey := errors.New("key failed")
+	f.err, f.errs = nil, loaders.KeyErrors[string]{"b": errKey}
+	values, errs := loadAll(l, "a", "b")
+	if errs[0] != nil || values[0] != "value of a" {
+		t.Errorf("Load of key without error returned %q, error: %v", values[0], errs[0])
+	}
+	if !errors.Is(errs[1], errKey) {
+		t.Errorf("Load of failed key returned error: %v, want %v", errs[1], errKey)
+	}
+}
+
+func TestLoaderContext(t *testing.T) {
+	ctx := storage.WithSession(context.Background())
+	storage.MarkWritten(ctx)
+
+	var written bool
+	l := loaders.NewLoader(ctx, time.Millisecond, func(ctx context.Context, keys []string) (map[string]bool, error) {
+		written = storage.HasWritten(ctx)
+		return map[string]bool{}, nil
+	})
+
+	// Field that loads the key is cancelled once it gets the value, the batch is not
+	fieldCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := l.Load(fieldCtx, "key"); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !written {
+		t.Errorf("batch is fetched outside the session of the operation")
+	}
+
+	// Field that is cancelled stops waiting for the batch
+	l = loaders.NewLoader(ctx, time.Hour, func(ctx context.Context, keys []string) (map[string]bool, error) {
+		return map[string]bool{}, nil
+	})
+	cancel()
+	if _, err := l.Load(fieldCtx, "key"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Load with cancelled context returned error: %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,156 @@
+package loaders
+
+import (
+	"context"
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"time"
+)
+
+const (
+	batchWait = 2 * time.Millisecond
+)
+
+type ctxKey struct{}
+
+// Loaders batches the loads of nested fields made while resolving one operation
+type Loaders struct {
+	CommentsByPost     *Loader[PageKey, *model.CommentConnection]
+	ChildrenByComment  *Loader[PageKey, *model.CommentConnection]
+	PostsByUser        *Loader[string, []*model.Post]
+	VotesByUser        *Loader[VoteKey, model.VoteValue]
+	Comments           *Loader[string, *model.Comment]
+	AncestorsByComment *Loader[string, []*model.Comment]
+}
+
+// VoteKey identifies the vote of the user for the comment
+type VoteKey struct {
+	UserID    string
+	CommentID string
+}
+
+// PageKey identifies a page of comments of a post or of a comment.
+// First and After are set if HasFirst and HasAfter are, Sort is empty if it is not set.
+type PageKey struct {
+	ID       string
+	First    int32
+	HasFirst bool
+	After    string
+	HasAfter bool
+	Sort     model.CommentSort
+}
+
+// NewPageKey creates a key for the page of the post or the comment with id
+func NewPageKey(id string, first *int32, after *string, sort *model.CommentSort) PageKey {
+	key := PageKey{ID: id}
+	if first != nil {
+		key.First, key.HasFirst = *first, true
+	}
+	if after != nil {
+		key.After, key.HasAfter = *after, true
+	}
+	if sort != nil {
+		key.Sort = *sort
+	}
+	return key
+}
+
+// Page returns storage page without id, invalid arguments are passed as they are and are validated by storage
+func (k PageKey) Page() storage.Page {
+	page := storage.Page{Sort: k.Sort}
+	if k.HasFirst {
+		first := k.First
+		page.First = &first
+	}
+	if k.HasAfter {
+		after := k.After
+		page.After = &after
+	}
+	return page
+}
+
+// NewLoaders creates loaders of the operation with ctx that read from store
+func NewLoaders(ctx context.Context, store storage.Storage) *Loaders {
+	return &Loaders{
+		CommentsByPost:     NewLoader(ctx, batchWait, pagesFetcher(store.GetCommentsByPosts)),
+		ChildrenByComment:  NewLoader(ctx, batchWait, pagesFetcher(store.GetChildrenByComments)),
+		PostsByUser:        NewLoader(ctx, batchWait, store.GetPostsByUsers),
+		VotesByUser:        NewLoader(ctx, batchWait, votesFetcher(store)),
+		Comments:           NewLoader(ctx, batchWait, store.GetComments),
+		AncestorsByComment: NewLoader(ctx, batchWait, store.GetAncestorsByComments),
+	}
+}
+
+// pagesFetcher groups keys by page and gets every group with one call of get,
+// keys of a group that fails get its error
+func pagesFetcher(get func(ctx context.Context, ids []string, page storage.Page) (map[string]*model.CommentConnection, error),
+) func(context.Context, []PageKey) (map[PageKey]*model.CommentConnection, error) {
+	return func(ctx context.Context, keys []PageKey) (map[PageKey]*model.CommentConnection, error) {
+		// Keys of a group differ only by id
+		groups := make(map[PageKey][]string)
+		for _, key := range keys {
+			group := key
+			group.ID = ""
+			groups[group] = append(groups[group], key.ID)
+		}
+
+		result := make(map[PageKey]*model.CommentConnection, len(keys))
+		errs := make(KeyErrors[PageKey])
+		for group, ids := range groups {
+			pages, err := get(ctx, ids, group.Page())
+			for _, id := range ids {
+				key := group
+				key.ID = id
+				if err != nil {
+					errs[key] = err
+				} else {
+					result[key] = pages[id]
+				}
+			}
+		}
+		if len(errs) > 0 {
+			return result, errs
+		}
+		return result, nil
+	}
+}
+
+// votesFetcher groups keys by user and gets votes of every user with one call,
+// comments the user hasn't voted for get NONE
+func votesFetcher(store storage.Storage) func(context.Context, []VoteKey) (map[VoteKey]model.VoteValue, error) {
+	return func(ctx context.Context, keys []VoteKey) (map[VoteKey]model.VoteValue, error) {
+		groups := make(map[string][]string)
+		for _, key := range keys {
+			groups[key.UserID] = append(groups[key.UserID], key.CommentID)
+		}
+
+		result := make(map[VoteKey]model.VoteValue, len(keys))
+		for userId, commentIds := range groups {
+			votes, err := store.GetVotes(ctx, userId, commentIds)
+			if err != nil {
+				return nil, err
+			}
+			for _, commentId := range commentIds {
+				vote, ok := votes[commentId]
+				if !ok {
+					vote = model.VoteValueNone
+				}
+				result[VoteKey{UserID: userId, CommentID: commentId}] = vote
+			}
+		}
+		return result, nil
+	}
+}
+
+// Middleware gives every operation its own loaders
+func Middleware(store storage.Storage) graphql.OperationMiddleware {
+	return func(ctx context.Context, next graphql.OperationHandler) graphql.ResponseHandler {
+		return next(context.WithValue(ctx, ctxKey{}, NewLoaders(ctx, store)))
+	}
+}
+
+// For returns loaders of the operation
+func For(ctx context.Context) *Loaders {
+	return ctx.Value(ctxKey{}).(*Loaders)
+}
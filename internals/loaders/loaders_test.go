@@ -0,0 +1,82 @@
+package loaders_test
+
+import (
+	"context"
+	"errors"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/loaders"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"sync"
+	"testing"
+)
+
+func TestPageKey(t *testing.T) {
+	first, after, sort := int32(5), "cursor", model.CommentSortNewest
+	page := loaders.NewPageKey("id", &first, &after, &sort).Page()
+	if page.First == nil || *page.First != first || page.After == nil || *page.After != after || page.Sort != sort {
+		t.Errorf("Page of key with arguments returned %+v", page)
+	}
+
+	// Invalid arguments stay set, so storage rejects them
+	first, after = -1, ""
+	page = loaders.NewPageKey("id", &first, &after, nil).Page()
+	if page.First == nil || *page.First != -1 || page.After == nil || *page.After != "" {
+		t.Errorf("Page of key with invalid arguments returned %+v", page)
+	}
+	if key := loaders.NewPageKey("id", &first, &after, nil); key == loaders.NewPageKey("id", nil, nil, nil) {
+		t.Errorf("key with invalid arguments is the key without them: %+v", key)
+	}
+
+	page = loaders.NewPageKey("id", nil, nil, nil).Page()
+	if page.First != nil || page.After != nil || page.Sort != "" {
+		t.Errorf("Page of key without arguments returned %+v", page)
+	}
+}
+
+func TestCommentsByPost(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewCache()
+	alice, err := store.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	post, err := store.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = store.AddComment(ctx, alice.ID, post.ID, post.ID, "text"); err != nil {
+			t.Fatalf("AddComment: %v", err)
+		}
+	}
+
+	// Pages of one batch are read by page, an invalid page fails only its own key
+	one, negative := int32(1), int32(-1)
+	keys := []loaders.PageKey{
+		loaders.NewPageKey(post.ID, nil, nil, nil),
+		loaders.NewPageKey(post.ID, &one, nil, nil),
+		loaders.NewPageKey(post.ID, &negative, nil, nil),
+	}
+	l := loaders.NewLoaders(ctx, store).CommentsByPost
+	pages := make([]*model.CommentConnection, len(keys))
+	errs := make([]error, len(keys))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pages[i], errs[i] = l.Load(ctx, key)
+		}()
+	}
+	wg.Wait()
+
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("valid pages returned errors: %v, %v", errs[0], errs[1])
+	}
+	if len(pages[0].Edges) != 3 || len(pages[1].Edges) != 1 {
+		t.Errorf("pages returned %v and %v comments, want 3 and 1", len(pages[0].Edges), len(pages[1].Edges))
+	}
+	if !errors.Is(errs[2], storage.ErrValidation) {
+		t.Errorf("page with negative first returned error: %v, want %v", errs[2], storage.ErrValidation)
+	}
+}
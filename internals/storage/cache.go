@@ -1,211 +1,1138 @@
 package storage
 
 import (
-	"fmt"
+	"context"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/globalid"
 	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
-	"github.com/google/uuid"
+	"hash/fnv"
 	"log"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const (
-	maxCommentLength = 2000
-)
+// cacheStripes is the number of locks posts are spread over
+const cacheStripes = 64
 
+// Cache keeps everything in memory. The write lock of m is taken to add or remove users and posts,
+// everything else takes the read lock of m and the lock of the post it reads or changes,
+// so comments to different posts are written concurrently.
+// Entities of the cache never leave it, callers get copies made under the locks.
 type Cache struct {
-	UserCache     map[string]*model.User
-	PostsCache    map[string]*model.Post
-	CommentsCache map[string]*model.Comment
-	m             sync.RWMutex
+	UserCache  map[string]*model.User
+	PostsCache map[string]*model.Post
+	m          sync.RWMutex
+	// stripes guard fields and comment trees of posts, the lock of a post is stripe(postId)
+	stripes [cacheStripes]sync.RWMutex
+	// comments keeps *cachedComment by id of the comment, commentCount is their number
+	comments     sync.Map
+	commentCount atomic.Int64
+	// usernames and emails index users for uniqueness checks
+	usernames map[string]*model.User
+	emails    map[string]*model.User
+	hub       *CommentHub
+	// usersOrder and postsOrder keep users and posts in the order they were added, postSeq keeps
+	// positions of posts in the order they were added. lastSeq is also the key of the last global id
+	usersOrder []*model.User
+	postsOrder []*model.Post
+	postSeq    map[string]int64
+	lastSeq    atomic.Int64
+	// persist writes mutations to disk, it is nil if the cache is not persistent
+	persist *cacheLog
+	// limits bound posts and comments, bytes is the approximate size of all entities
+	limits          CacheLimits
+	bytes           atomic.Int64
+	evictedPosts    int64
+	evictedComments int64
+	// maxDepth is the maximum depth of comments, zero means no limit
+	maxDepth atomic.Int32
+}
+
+// cachedComment is a comment with its position in the order comments were added, and votes for it
+// by id of the user, 1 or -1. Votes are guarded by the lock of the post of the comment.
+type cachedComment struct {
+	comment *model.Comment
+	seq     int64
+	votes   map[string]int8
 }
 
 // NewCache creates a new cache instance
 func NewCache() *Cache {
-	return &Cache{
-		UserCache:     make(map[string]*model.User),
-		PostsCache:    make(map[string]*model.Post),
-		CommentsCache: make(map[string]*model.Comment),
+	c := &Cache{
+		UserCache:  make(map[string]*model.User),
+		PostsCache: make(map[string]*model.Post),
+		usernames:  make(map[string]*model.User),
+		emails:     make(map[string]*model.User),
+		hub:        NewCommentHub(),
+		postSeq:    make(map[string]int64),
+	}
+	c.maxDepth.Store(DefaultMaxCommentDepth)
+	return c
+}
+
+// SetMaxCommentDepth sets the maximum depth of comments, 0 means no limit. Comments that are already deeper stay.
+func (c *Cache) SetMaxCommentDepth(depth int32) {
+	c.maxDepth.Store(depth)
+}
+
+// stripe returns the lock of the post
+func (c *Cache) stripe(postId string) *sync.RWMutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(postId))
+	return &c.stripes[h.Sum32()%cacheStripes]
+}
+
+// cached returns the comment with its position and votes via id
+func (c *Cache) cached(commentId string) (*cachedComment, bool) {
+	v, ok := c.comments.Load(commentId)
+	if !ok {
+		return nil, false
 	}
+	return v.(*cachedComment), true
 }
 
-// GetPost returns post via id, or return error if there is no such post
-func (c *Cache) GetPost(postId string) (*model.Post, error) {
+// comment returns comment via id
+func (c *Cache) comment(commentId string) (*model.Comment, bool) {
+	cc, ok := c.cached(commentId)
+	if !ok {
+		return nil, false
+	}
+	return cc.comment, true
+}
+
+// commentSeq returns position of the comment in the order comments were added
+func (c *Cache) commentSeq(commentId string) int64 {
+	cc, ok := c.cached(commentId)
+	if !ok {
+		return 0
+	}
+	return cc.seq
+}
+
+// seenSeq moves lastSeq to seq of a restored entity, so new ids continue after it
+func (c *Cache) seenSeq(seq int64) {
+	for last := c.lastSeq.Load(); seq > last; last = c.lastSeq.Load() {
+		if c.lastSeq.CompareAndSwap(last, seq) {
+			return
+		}
+	}
+}
+
+// GetPost returns post via id with its comment tree preloaded up to maxDepth levels,
+// or return error if there is no such post
+func (c *Cache) GetPost(ctx context.Context, postId string, maxDepth int32) (*model.Post, error) {
 	c.m.RLock()
 	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
 
 	post, ok := c.PostsCache[postId]
 	if !ok {
 
-		return nil, fmt.Errorf("No such post: %v", postId)
+		return nil, NewError(ErrNotFound, "Post: %v doesn't exist", postId)
+	}
+
+	mu := c.stripe(postId)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	// The post is copied under its lock, and the tree is cut at maxDepth without changing the cache
+	tree := copyPost(post)
+	if maxDepth == 0 {
+		return tree, nil
 	}
-	return post, nil
+	tree.Comments = copyTree(post.Comments, 1, maxDepth, allReplies)
+	tree.CommentsLoaded = true
+	return tree, nil
 }
 
-// GetAllPosts returns all posts from cache
-func (c *Cache) GetAllPosts() ([]*model.Post, error) {
-	var posts []*model.Post
+// copyTree copies comments at depth and their children up to maxDepth,
+// children of comments with more than maxBreadth children are not copied
+func copyTree(comments []*model.Comment, depth, maxDepth, maxBreadth int32) []*model.Comment {
+	tree := make([]*model.Comment, 0, len(comments))
+	for _, comment := range comments {
+		node := copyComment(comment)
+		if (maxDepth == WholeTree || depth < maxDepth) && fitsBreadth(comment.ChildrenCount, maxBreadth) {
+			node.Children = copyTree(comment.Children, depth+1, maxDepth, maxBreadth)
+			node.ChildrenLoaded = true
+		}
+		tree = append(tree, node)
+	}
+	return tree
+}
+
+// copyPost returns a copy of the post without its comments, the lock of the post must be held
+func copyPost(post *model.Post) *model.Post {
+	p := *post
+	p.Comments = nil
+	p.CommentsLoaded = false
+	return &p
+}
+
+// copyComment returns a copy of the comment without its replies, the lock of its post must be held
+func copyComment(comment *model.Comment) *model.Comment {
+	node := *comment
+	node.Children = nil
+	node.ChildrenLoaded = false
+	return &node
+}
+
+// readPost returns a copy of the post made under its lock, read lock of the cache must be held
+func (c *Cache) readPost(post *model.Post) *model.Post {
+	mu := c.stripe(post.ID)
+	mu.RLock()
+	defer mu.RUnlock()
+	return copyPost(post)
+}
+
+// readPosts returns copies of posts, read lock of the cache must be held
+func (c *Cache) readPosts(posts []*model.Post) []*model.Post {
+	copies := make([]*model.Post, len(posts))
+	for i, post := range posts {
+		copies[i] = c.readPost(post)
+	}
+	return copies
+}
+
+// copyUser returns a copy of the user with copies of its posts, read lock of the cache must be held
+func (c *Cache) copyUser(user *model.User) *model.User {
+	u := *user
+	if user.Posts != nil {
+		u.Posts = c.readPosts(user.Posts)
+	}
+	return &u
+}
 
+// GetAllPosts returns all posts from cache in the order they were added
+func (c *Cache) GetAllPosts(ctx context.Context) ([]*model.Post, error) {
 	c.m.RLock()
 	defer c.m.RUnlock()
-
-	for _, post := range c.PostsCache {
-		posts = append(posts, post)
+	if err := checkContext(ctx); err != nil {
+		return nil, err
 	}
 
+	posts := c.readPosts(c.postsOrder)
+
 	if len(posts) == 0 {
 		log.Println("There is no post in the cache")
 	}
 	return posts, nil
 }
 
+// GetPosts returns a page of posts, newest first
+func (c *Cache) GetPosts(ctx context.Context, page Page) (*model.PostConnection, error) {
+	b, err := page.bounds()
+	if err != nil {
+		return nil, err
+	}
+
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	// postsOrder is sorted by seq, so the posts between cursors are postsOrder[lo:hi], the newest is the last one
+	lo, hi := 0, len(c.postsOrder)
+	if b.hasBefore {
+		lo = sort.Search(len(c.postsOrder), func(i int) bool {
+			return c.postSeq[c.postsOrder[i].ID] > b.before
+		})
+	}
+	if b.hasAfter {
+		hi = sort.Search(len(c.postsOrder), func(i int) bool {
+			return c.postSeq[c.postsOrder[i].ID] >= b.after
+		})
+	}
+	if hi < lo {
+		hi = lo
+	}
+
+	var from, to int
+	var hasNext, hasPrevious bool
+	if b.backward {
+		from, to = lo, min(lo+b.limit, hi)
+		hasNext = lo > 0
+		hasPrevious = to < hi
+	} else {
+		from, to = max(hi-b.limit, lo), hi
+		hasNext = from > lo
+		hasPrevious = hi < len(c.postsOrder)
+	}
+
+	edges := make([]*model.PostEdge, 0, to-from)
+	for i := to - 1; i >= from; i-- {
+		post := c.postsOrder[i]
+		edges = append(edges, &model.PostEdge{
+			Cursor: encodeCursor(c.postSeq[post.ID]),
+			Node:   c.readPost(post),
+		})
+	}
+
+	return &model.PostConnection{
+		Edges:      edges,
+		PageInfo:   newPageInfo(len(edges), func(i int) string { return edges[i].Cursor }, hasNext, hasPrevious),
+		TotalCount: int32(len(c.postsOrder)),
+	}, nil
+}
+
+// GetCommentsByPosts returns a page of top level comments in the order of the page for each post.
+// Unknown posts get an empty page.
+func (c *Cache) GetCommentsByPosts(ctx context.Context, postIds []string, page Page) (map[string]*model.CommentConnection, error) {
+	b, err := page.commentBounds()
+	if err != nil {
+		return nil, err
+	}
+
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	pages := make(map[string]*model.CommentConnection, len(postIds))
+	for _, postId := range postIds {
+		var comments []*model.Comment
+		mu := c.stripe(postId)
+		mu.RLock()
+		if post, ok := c.PostsCache[postId]; ok {
+			comments = post.Comments
+		}
+		pages[postId] = c.commentsPage(comments, b)
+		mu.RUnlock()
+	}
+	return pages, nil
+}
+
+// GetChildrenByComments returns a page of replies in the order of the page for each comment.
+// Unknown comments get an empty page.
+func (c *Cache) GetChildrenByComments(ctx context.Context, commentIds []string, page Page) (map[string]*model.CommentConnection, error) {
+	b, err := page.commentBounds()
+	if err != nil {
+		return nil, err
+	}
+
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	pages := make(map[string]*model.CommentConnection, len(commentIds))
+	for _, commentId := range commentIds {
+		comment, ok := c.comment(commentId)
+		if !ok {
+			pages[commentId] = c.commentsPage(nil, b)
+			continue
+		}
+		mu := c.stripe(comment.PostID)
+		mu.RLock()
+		pages[commentId] = c.commentsPage(comment.Children, b)
+		mu.RUnlock()
+	}
+	return pages, nil
+}
+
+// GetComment returns comment via id with its replies preloaded up to maxDepth levels below it,
+// or returns error if there is no such comment
+func (c *Cache) GetComment(ctx context.Context, commentId string, maxDepth int32) (*model.Comment, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	comment, ok := c.comment(commentId)
+	if !ok {
+		return nil, NewError(ErrNotFound, "Comment: %v doesn't exist", commentId)
+	}
+	mu := c.stripe(comment.PostID)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	// The comment could be removed before the lock is taken
+	if _, ok = c.comment(commentId); !ok {
+		return nil, NewError(ErrNotFound, "Comment: %v doesn't exist", commentId)
+	}
+	node := copyComment(comment)
+	if maxDepth != 0 && fitsBreadth(comment.ChildrenCount, commentWindowBreadth) {
+		node.Children = copyTree(comment.Children, 1, maxDepth, commentWindowBreadth)
+		node.ChildrenLoaded = true
+	}
+	return node, nil
+}
+
+// GetComments returns comments via ids without their replies, unknown comments are skipped
+func (c *Cache) GetComments(ctx context.Context, commentIds []string) (map[string]*model.Comment, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	comments := make(map[string]*model.Comment, len(commentIds))
+	for _, commentId := range commentIds {
+		comment, ok := c.comment(commentId)
+		if !ok {
+			continue
+		}
+		mu := c.stripe(comment.PostID)
+		mu.RLock()
+		comments[commentId] = copyComment(comment)
+		mu.RUnlock()
+	}
+	return comments, nil
+}
+
+// GetAncestorsByComments returns parents of each comment from its top level comment down to its parent,
+// top level comments have none. Unknown comments are skipped.
+func (c *Cache) GetAncestorsByComments(ctx context.Context, commentIds []string) (map[string][]*model.Comment, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	ancestors := make(map[string][]*model.Comment, len(commentIds))
+	for _, commentId := range commentIds {
+		if chain, ok := c.ancestors(commentId); ok {
+			ancestors[commentId] = chain
+		}
+	}
+	return ancestors, nil
+}
+
+// ancestors copies parents of the comment from its top level comment down to its parent,
+// it returns false if there is no such comment. The lock of the cache must be held.
+func (c *Cache) ancestors(commentId string) ([]*model.Comment, bool) {
+	comment, ok := c.comment(commentId)
+	if !ok {
+		return nil, false
+	}
+	mu := c.stripe(comment.PostID)
+	mu.RLock()
+	defer mu.RUnlock()
+
+	// The comment could be removed before the lock is taken, its parents are removed only after it
+	if _, ok = c.comment(commentId); !ok {
+		return nil, false
+	}
+	ancestors := make([]*model.Comment, 0, max(comment.Depth-1, 0))
+	for comment.ParentID != comment.PostID {
+		if comment, ok = c.comment(comment.ParentID); !ok {
+			break
+		}
+		ancestors = append(ancestors, copyComment(comment))
+	}
+	slices.Reverse(ancestors)
+	return ancestors, true
+}
+
+// GetPostsByUsers returns posts of each user in the order they were added
+func (c *Cache) GetPostsByUsers(ctx context.Context, userIds []string) (map[string][]*model.Post, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	posts := make(map[string][]*model.Post, len(userIds))
+	for _, userId := range userIds {
+		if user, ok := c.UserCache[userId]; ok {
+			posts[userId] = c.readPosts(user.Posts)
+		}
+	}
+	return posts, nil
+}
+
+// commentsPage cuts a page from comments sorted in the order they were added, and copies its comments.
+// The lock of their post must be held.
+func (c *Cache) commentsPage(comments []*model.Comment, b commentBounds) *model.CommentConnection {
+	page := commentsPage(comments, b, func(i int) int64 { return c.commentSeq(comments[i].ID) })
+	for _, edge := range page.Edges {
+		edge.Node = copyComment(edge.Node)
+	}
+	return page
+}
+
+// GetUser returns user via id, or returns error if there is no such user
+func (c *Cache) GetUser(ctx context.Context, userId string) (*model.User, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	user, ok := c.UserCache[userId]
+	if !ok {
+		return nil, NewError(ErrNotFound, "User: %v doesn't exist", userId)
+	}
+	return c.copyUser(user), nil
+}
+
+// GetUserByUsername returns user via username, or returns error if there is no such user
+func (c *Cache) GetUserByUsername(ctx context.Context, username string) (*model.User, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	if user, ok := c.usernames[username]; ok {
+		return c.copyUser(user), nil
+	}
+	return nil, NewError(ErrNotFound, "User with username: %v doesn't exist", username)
+}
+
+// GetUsers returns all users in the order they were added
+func (c *Cache) GetUsers(ctx context.Context) ([]*model.User, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	users := make([]*model.User, len(c.usersOrder))
+	for i, user := range c.usersOrder {
+		users[i] = c.copyUser(user)
+	}
+	return users, nil
+}
+
 // AddUser adds user to cache, and returns this user
 // or returns error if there is already a user with such name or such email.
-func (c *Cache) AddUser(name, email string) (*model.User, error) {
+func (c *Cache) AddUser(ctx context.Context, name, email string) (*model.User, error) {
 	c.m.Lock()
 	defer c.m.Unlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
 	// Check if there is a user with such name or email
-	for _, user := range c.UserCache {
-		if user.Username == name {
-			return nil, fmt.Errorf("User with username: %v is already exists", name)
-		}
-		if user.Email == email {
-			return nil, fmt.Errorf("User with email: %v is already exists", email)
-		}
+	if _, ok := c.usernames[name]; ok {
+		return nil, NewError(ErrConflict, "User with username: %v is already exists", name)
+	}
+	if _, ok := c.emails[email]; ok {
+		return nil, NewError(ErrConflict, "User with email: %v is already exists", email)
 	}
 
 	var posts []*model.Post
 
-	// Create a user with new uuid
-	id := uuid.New()
+	// Create a user with new id
+	seq := c.lastSeq.Add(1)
+	id := globalid.Encode(globalid.User, seq)
+	now := time.Now().UTC()
 	user := &model.User{
-		ID:       id.String(),
-		Username: name,
-		Email:    email,
-		Posts:    posts,
+		ID:        id,
+		Username:  name,
+		Email:     email,
+		Posts:     posts,
+		CreatedAt: now,
+		UpdatedAt: now,
 	}
 
-	// Add user to cache
-	c.UserCache[id.String()] = user
+	if err := c.record(&logRecord{Op: opAddUser, User: user}); err != nil {
+		return nil, err
+	}
+	c.applyAddUser(user, seq)
+	c.evict("")
 
-	return user, nil
+	u := *user
+	return &u, nil
+}
+
+// applyAddUser adds user with seq to cache
+func (c *Cache) applyAddUser(user *model.User, seq int64) {
+	c.UserCache[user.ID] = user
+	c.usernames[user.Username] = user
+	c.emails[user.Email] = user
+	c.usersOrder = append(c.usersOrder, user)
+	c.seenSeq(seq)
+	c.bytes.Add(userSize(user))
 }
 
 // AddPost adds post to cache, and returns this post or returns error if the is no such user, empty text or title
-func (c *Cache) AddPost(userId string, title string, text string, allowComments bool) (*model.Post, error) {
+func (c *Cache) AddPost(ctx context.Context, userId string, title string, text string, allowComments bool) (*model.Post, error) {
 	var comments []*model.Comment
 
 	c.m.Lock()
 	defer c.m.Unlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
 
 	// Return error if there is no such user
-	user, ok := c.UserCache[userId]
-	if !ok {
-		return nil, fmt.Errorf("User: %v doesn't exist", userId)
+	if _, ok := c.UserCache[userId]; !ok {
+		return nil, NewError(ErrNotFound, "User: %v doesn't exist", userId)
 	}
 
 	// Returns error if the title
 	if title == "" {
-		return nil, fmt.Errorf("Title: %v is empty", userId)
+		return nil, NewError(ErrValidation, "Title of post is empty")
 	}
 	// Returns error if the text is empty
 	if text == "" {
-		return nil, fmt.Errorf("User: %v doesn't exist", userId)
+		return nil, NewError(ErrValidation, "Text of post is empty")
 	}
 
 	if !allowComments {
 		comments = nil
 	}
 
-	// Create a post with new uuid
-	id := uuid.New()
+	// Create a post with new id
+	seq := c.lastSeq.Add(1)
+	now := time.Now().UTC()
 	post := &model.Post{
-		ID:            id.String(),
+		ID:            globalid.Encode(globalid.Post, seq),
 		UserID:        userId,
 		Title:         title,
 		Text:          text,
 		Comments:      comments,
 		AllowComments: allowComments,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	// Post without comments is closed for comments from the start
+	if !allowComments {
+		post.CommentsClosedAt = &now
+	}
+
+	if err := c.record(&logRecord{Op: opAddPost, Post: post}); err != nil {
+		return nil, err
+	}
+	c.applyAddPost(post, seq)
+	c.evict(post.ID)
+	return copyPost(post), nil
+}
+
+// applyAddPost adds post with seq to cache and to posts of its user
+func (c *Cache) applyAddPost(post *model.Post, seq int64) {
+	if user, ok := c.UserCache[post.UserID]; ok {
+		user.Posts = append(user.Posts, post)
 	}
-	// Add post to users posts
-	user.Posts = append(user.Posts, post)
 
-	// Add post to cache
 	c.PostsCache[post.ID] = post
-	return post, nil
+	c.postSeq[post.ID] = seq
+	c.postsOrder = append(c.postsOrder, post)
+	c.seenSeq(seq)
+	c.bytes.Add(postSize(post))
 }
 
 // AddComment adds comment to cache, and returns this comment or returns error if there is no such user or post,
 // if comments are not allowed. It returns error if comment is empty or more then 2000 symbols.
-func (c *Cache) AddComment(userId, postId, parentId, text string) (*model.Comment, error) {
+func (c *Cache) AddComment(ctx context.Context, userId, postId, parentId, text string) (*model.Comment, error) {
+	// Eviction needs the write lock, so it runs after the locks are released
+	defer c.shrink(postId)
 
-	c.m.Lock()
-	defer c.m.Unlock()
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
 
 	// Check the length of the comment, if it is empty or more the 2000 symbols return mistake
-	if text == "" {
-		return nil, fmt.Errorf("Comment: %v is empty", text)
-	}
-	if len([]rune(text)) > maxCommentLength {
-		return nil, fmt.Errorf("Comment: %v is too long, it should be no more then a %v symbols", text, maxCommentLength)
+	if err := checkCommentText(text); err != nil {
+		return nil, err
 	}
 
 	// Check if there is a user
 	_, ok := c.UserCache[userId]
 	if !ok {
-		return nil, fmt.Errorf("User: %v doesn't exist", userId)
+		return nil, NewError(ErrNotFound, "User: %v doesn't exist", userId)
 	}
 	// Check if there is a post
 	post, ok := c.PostsCache[postId]
 	if !ok {
-		return nil, fmt.Errorf("Post: %v doesn't exist", postId)
+		return nil, NewError(ErrNotFound, "Post: %v doesn't exist", postId)
 	}
+
+	mu := c.stripe(postId)
+	mu.Lock()
+	defer mu.Unlock()
+
 	// Check if comments are allowed
 	if !post.AllowComments {
-		return nil, fmt.Errorf("Comments for post: %v are not allowed", postId)
+		return nil, commentsClosedError(postId, post.CommentsClosedReason)
 	}
 
-	var children []*model.Comment
-	// Check if parent is a post, create a comment and add it to comment cache and to post cache
-	if parentId == postId {
-
-		id := uuid.New()
-		comment := &model.Comment{
-			ID:        id.String(),
-			UserID:    userId,
-			PostID:    postId,
-			ParentID:  postId,
-			Text:      text,
-			CreatedAt: fmt.Sprintf("%v", time.Now()),
-			Children:  children,
+	// Check if there is a parent comment, it is checked before the comment is written to the log.
+	// Replies are kept in the tree of the post they are written to, which is guarded by the lock of this post
+	depth := int32(1)
+	if parentId != postId {
+		parent, ok := c.comment(parentId)
+		if !ok {
+			return nil, NewError(ErrNotFound, "Comment: %v doesn't exist", parentId)
 		}
-
-		c.CommentsCache[comment.ID] = comment
-
-		post.Comments = append(post.Comments, comment)
-
-		return comment, nil
+		if parent.PostID != postId {
+			return nil, NewError(ErrValidation, "Comment: %v doesn't belong to post: %v", parentId, postId)
+		}
+		if err := checkCommentDepth(parentId, parent.Depth, c.maxDepth.Load()); err != nil {
+			return nil, err
+		}
+		depth = parent.Depth + 1
 	}
 
-	// If parent is a comment, create comment, add it to comment cache, add it to parent's children comments
-	// and add it to post cache
-	id := uuid.New()
+	var children []*model.Comment
+	now := time.Now().UTC()
+
+	// Parent of top level comments is the post
+	seq := c.lastSeq.Add(1)
 	comment := &model.Comment{
-		ID:        id.String(),
+		ID:        globalid.Encode(globalid.Comment, seq),
 		UserID:    userId,
 		PostID:    postId,
 		ParentID:  parentId,
 		Text:      text,
-		CreatedAt: fmt.Sprintf("%v", time.Now()),
+		CreatedAt: now,
+		UpdatedAt: now,
 		Children:  children,
+		Depth:     depth,
+	}
+
+	if err := c.record(&logRecord{Op: opAddComment, Comment: comment}); err != nil {
+		return nil, err
+	}
+	c.applyAddComment(comment, seq)
+
+	// Subscribers and the caller get their own copies
+	c.hub.Publish(copyComment(comment))
+
+	return copyComment(comment), nil
+}
+
+// applyAddComment adds comment with seq to cache, and to top level comments of its post
+// or to children of its parent comment. Depth is set by the parent, logs written before comments had it have none.
+func (c *Cache) applyAddComment(comment *model.Comment, seq int64) {
+	comment.Cursor = encodeCursor(seq)
+	comment.Depth = 1
+	c.comments.Store(comment.ID, &cachedComment{comment: comment, seq: seq})
+	c.commentCount.Add(1)
+	c.seenSeq(seq)
+	c.bytes.Add(commentSize(comment))
+
+	if comment.ParentID == comment.PostID {
+		if post, ok := c.PostsCache[comment.PostID]; ok {
+			post.Comments = append(post.Comments, comment)
+		}
+		return
+	}
+	if parent, ok := c.comment(comment.ParentID); ok {
+		comment.Depth = parent.Depth + 1
+		parent.Children = append(parent.Children, comment)
+		parent.ChildrenCount++
+	}
+}
+
+// UpdatePost changes title and text of the post if they are set, and returns this post.
+// It returns error if there is no such post, user is not its author, or new title or text is empty.
+func (c *Cache) UpdatePost(ctx context.Context, userId, postId string, title, text *string) (*model.Post, error) {
+	defer c.shrink(postId)
+
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	post, ok := c.PostsCache[postId]
+	if !ok {
+		return nil, NewError(ErrNotFound, "Post: %v doesn't exist", postId)
+	}
+
+	mu := c.stripe(postId)
+	mu.Lock()
+	defer mu.Unlock()
+	if post.UserID != userId {
+		return nil, NewError(ErrForbidden, "User: %v is not the author of post: %v", userId, postId)
+	}
+	if title != nil && *title == "" {
+		return nil, NewError(ErrValidation, "Title of post: %v is empty", postId)
+	}
+	if text != nil && *text == "" {
+		return nil, NewError(ErrValidation, "Text of post: %v is empty", postId)
+	}
+
+	updated := *post
+	if title != nil {
+		updated.Title = *title
+	}
+	if text != nil {
+		updated.Text = *text
+	}
+	updated.UpdatedAt = time.Now().UTC()
+
+	if err := c.record(&logRecord{Op: opUpdatePost, Post: &updated}); err != nil {
+		return nil, err
+	}
+	c.applyUpdatePost(&updated)
+	return copyPost(post), nil
+}
+
+// applyUpdatePost sets title, text, permission for comments and time of update of the post from updated
+func (c *Cache) applyUpdatePost(updated *model.Post) {
+	post, ok := c.PostsCache[updated.ID]
+	if !ok {
+		return
+	}
+	c.bytes.Add(postSize(updated) - postSize(post))
+	post.Title = updated.Title
+	post.Text = updated.Text
+	post.AllowComments = updated.AllowComments
+	post.CommentsClosedAt = updated.CommentsClosedAt
+	post.CommentsClosedReason = updated.CommentsClosedReason
+	post.UpdatedAt = updated.UpdatedAt
+}
+
+// DeletePost removes the post with all its comments,
+// or returns error if there is no such post or user is not its author
+func (c *Cache) DeletePost(ctx context.Context, userId, postId string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	post, ok := c.PostsCache[postId]
+	if !ok {
+		return NewError(ErrNotFound, "Post: %v doesn't exist", postId)
+	}
+	if post.UserID != userId {
+		return NewError(ErrForbidden, "User: %v is not the author of post: %v", userId, postId)
+	}
+
+	if err := c.record(&logRecord{Op: opDeletePost, ID: postId}); err != nil {
+		return err
+	}
+	c.applyDeletePost(post)
+	return nil
+}
+
+// applyDeletePost removes the post with all its comments from cache
+func (c *Cache) applyDeletePost(post *model.Post) {
+	postId := post.ID
+
+	// Remove post from users posts
+	if user, ok := c.UserCache[post.UserID]; ok {
+		user.Posts = removeItem(user.Posts, post)
+	}
+
+	// Remove post from the order, postsOrder is sorted by seq
+	seq := c.postSeq[postId]
+	i := sort.Search(len(c.postsOrder), func(i int) bool {
+		return c.postSeq[c.postsOrder[i].ID] >= seq
+	})
+	c.postsOrder = append(c.postsOrder[:i], c.postsOrder[i+1:]...)
+
+	c.removeComments(post.Comments)
+	delete(c.postSeq, postId)
+	delete(c.PostsCache, postId)
+	c.bytes.Add(-postSize(post))
+}
+
+// UpdateComment changes text of the comment and returns this comment. It returns error if there is no such comment,
+// user is not its author, comment is deleted, or new text is empty or more then 2000 symbols.
+func (c *Cache) UpdateComment(ctx context.Context, userId, commentId, text string) (*model.Comment, error) {
+	if err := checkCommentText(text); err != nil {
+		return nil, err
+	}
+
+	// Eviction keeps the post of the comment, it is known under the lock
+	var postId string
+	defer func() {
+		c.shrink(postId)
+	}()
+
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	comment, unlock, err := c.lockComment(commentId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	postId = comment.PostID
+	if comment.UserID != userId {
+		return nil, NewError(ErrForbidden, "User: %v is not the author of comment: %v", userId, commentId)
+	}
+
+	updated := *comment
+	updated.Text = text
+	updated.UpdatedAt = time.Now().UTC()
+
+	if err := c.record(&logRecord{Op: opUpdateComment, Comment: &updated}); err != nil {
+		return nil, err
+	}
+	c.applyUpdateComment(&updated)
+	return copyComment(comment), nil
+}
+
+// applyUpdateComment sets text and time of update of the comment from updated
+func (c *Cache) applyUpdateComment(updated *model.Comment) {
+	if comment, ok := c.comment(updated.ID); ok {
+		c.bytes.Add(commentSize(updated) - commentSize(comment))
+		comment.Text = updated.Text
+		comment.UpdatedAt = updated.UpdatedAt
+	}
+}
+
+// DeleteComment removes the comment, or returns error if there is no such comment or user is not its author.
+// Comment with replies stays in the tree as a tombstone, tombstones are removed with their last reply.
+func (c *Cache) DeleteComment(ctx context.Context, userId, commentId string) error {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return err
+	}
+
+	comment, unlock, err := c.lockComment(commentId)
+	if err != nil {
+		return err
 	}
+	defer unlock()
+	if comment.UserID != userId {
+		return NewError(ErrForbidden, "User: %v is not the author of comment: %v", userId, commentId)
+	}
+
+	now := time.Now().UTC()
+	if err := c.record(&logRecord{Op: opDeleteComment, ID: commentId, At: &now}); err != nil {
+		return err
+	}
+	c.applyDeleteComment(comment, now)
+	return nil
+}
+
+// applyDeleteComment removes the comment, or makes it a tombstone deleted at the time if it has replies
+func (c *Cache) applyDeleteComment(comment *model.Comment, at time.Time) {
+	for comment != nil {
+		if comment.ChildrenCount > 0 {
+			c.bytes.Add(-int64(len(comment.Text) - len(model.DeletedCommentText)))
+			comment.Text = model.DeletedCommentText
+			comment.Deleted = true
+			comment.UpdatedAt = at
+			return
+		}
 
-	c.CommentsCache[comment.ID] = comment
+		// Remove comment from its parent, and go on with the parent if it is a tombstone left without replies
+		c.forgetComment(comment)
+		parent, ok := c.comment(comment.ParentID)
+		if !ok {
+			if post, ok := c.PostsCache[comment.PostID]; ok {
+				post.Comments = removeItem(post.Comments, comment)
+			}
+			return
+		}
+		parent.Children = removeItem(parent.Children, comment)
+		parent.ChildrenCount--
 
-	parent := c.CommentsCache[parentId]
-	parent.Children = append(parent.Children, comment)
+		comment = nil
+		if parent.Deleted {
+			comment = parent
+		}
+	}
+}
 
-	post.Comments = append(post.Comments, comment)
+// SetCommentsAllowed opens or closes the post for comments and returns this post.
+// Reason is kept only when comments are closed. It returns error if there is no such post or user is not its author.
+func (c *Cache) SetCommentsAllowed(ctx context.Context, userId, postId string, allowed bool, reason *string) (*model.Post, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	post, ok := c.PostsCache[postId]
+	if !ok {
+		return nil, NewError(ErrNotFound, "Post: %v doesn't exist", postId)
+	}
+
+	mu := c.stripe(postId)
+	mu.Lock()
+	defer mu.Unlock()
+	if post.UserID != userId {
+		return nil, NewError(ErrForbidden, "User: %v is not the author of post: %v", userId, postId)
+	}
+
+	now := time.Now().UTC()
+	updated := *post
+	updated.AllowComments = allowed
+	updated.UpdatedAt = now
+	if allowed {
+		updated.CommentsClosedAt = nil
+		updated.CommentsClosedReason = nil
+	} else {
+		// Closing already closed post keeps the time it was closed
+		if updated.CommentsClosedAt == nil {
+			updated.CommentsClosedAt = &now
+		}
+		updated.CommentsClosedReason = reason
+	}
+
+	if err := c.record(&logRecord{Op: opUpdatePost, Post: &updated}); err != nil {
+		return nil, err
+	}
+	c.applyUpdatePost(&updated)
+	return copyPost(post), nil
+}
+
+// VoteComment sets the vote of the user for the comment, NONE takes the vote back, and returns this comment.
+// It returns error if there is no such user or comment, or the comment is deleted.
+func (c *Cache) VoteComment(ctx context.Context, userId, commentId string, value model.VoteValue) (*model.Comment, error) {
+	vote, err := voteOf(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var postId string
+	defer func() {
+		c.shrink(postId)
+	}()
+
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	comment, unlock, err := c.lockComment(commentId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	postId = comment.PostID
+	if _, ok := c.UserCache[userId]; !ok {
+		return nil, NewError(ErrNotFound, "User: %v doesn't exist", userId)
+	}
+
+	cc, _ := c.cached(commentId)
+	if cc.votes[userId] != vote {
+		if err := c.record(&logRecord{Op: opVoteComment, Vote: &commentVote{
+			CommentID: commentId,
+			UserID:    userId,
+			Value:     vote,
+		}}); err != nil {
+			return nil, err
+		}
+		c.applyVote(cc, userId, vote)
+	}
+	return copyComment(comment), nil
+}
+
+// applyVote sets the vote of the user for the comment, and changes counts of votes of the comment
+func (c *Cache) applyVote(cc *cachedComment, userId string, vote int8) {
+	old := cc.votes[userId]
+	up, down := voteDeltas(old, vote)
+	cc.comment.Upvotes += up
+	cc.comment.Downvotes += down
+
+	switch {
+	case vote == 0:
+		delete(cc.votes, userId)
+		if old != 0 {
+			c.bytes.Add(-voteSize(userId))
+		}
+	case old == 0:
+		if cc.votes == nil {
+			cc.votes = make(map[string]int8)
+		}
+		cc.votes[userId] = vote
+		c.bytes.Add(voteSize(userId))
+	default:
+		cc.votes[userId] = vote
+	}
+}
+
+// GetVotes returns votes of the user for comments, comments without a vote of the user are skipped
+func (c *Cache) GetVotes(ctx context.Context, userId string, commentIds []string) (map[string]model.VoteValue, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	votes := make(map[string]model.VoteValue)
+	for _, commentId := range commentIds {
+		cc, ok := c.cached(commentId)
+		if !ok {
+			continue
+		}
+		mu := c.stripe(cc.comment.PostID)
+		mu.RLock()
+		vote := cc.votes[userId]
+		mu.RUnlock()
+		if vote != 0 {
+			votes[commentId] = voteValue(vote)
+		}
+	}
+	return votes, nil
+}
+
+// removeComments removes comments and all their replies from cache
+func (c *Cache) removeComments(comments []*model.Comment) {
+	for _, comment := range comments {
+		c.removeComments(comment.Children)
+		c.forgetComment(comment)
+	}
+}
+
+// forgetComment removes the comment with its votes from the index of comments, it stays in the tree
+func (c *Cache) forgetComment(comment *model.Comment) {
+	v, ok := c.comments.LoadAndDelete(comment.ID)
+	if !ok {
+		return
+	}
+	for userId := range v.(*cachedComment).votes {
+		c.bytes.Add(-voteSize(userId))
+	}
+	c.commentCount.Add(-1)
+	c.bytes.Add(-commentSize(comment))
+}
+
+// lockComment takes the lock of the post of the comment and returns the comment with the function to unlock it,
+// or returns error if there is no such comment. Read lock of the cache must be held.
+func (c *Cache) lockComment(commentId string) (*model.Comment, func(), error) {
+	comment, ok := c.comment(commentId)
+	if !ok {
+		return nil, nil, NewError(ErrNotFound, "Comment: %v doesn't exist", commentId)
+	}
+	mu := c.stripe(comment.PostID)
+	mu.Lock()
+
+	// The comment could be removed or deleted before the lock is taken
+	if _, ok = c.comment(commentId); !ok || comment.Deleted {
+		mu.Unlock()
+		return nil, nil, NewError(ErrNotFound, "Comment: %v doesn't exist", commentId)
+	}
+	return comment, mu.Unlock, nil
+}
+
+// removeItem returns items without item, the order of other items is kept
+func removeItem[T comparable](items []T, item T) []T {
+	for i := range items {
+		if items[i] == item {
+			return append(items[:i:i], items[i+1:]...)
+		}
+	}
+	return items
+}
+
+// SubscribeComments returns a channel with new comments to the post, or returns error if there is no such post.
+// The channel is closed when ctx is done.
+func (c *Cache) SubscribeComments(ctx context.Context, postId string) (<-chan *model.Comment, error) {
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+
+	c.m.RLock()
+	_, ok := c.PostsCache[postId]
+	c.m.RUnlock()
+	if !ok {
+		return nil, NewError(ErrNotFound, "Post: %v doesn't exist", postId)
+	}
 
-	return comment, nil
+	return c.hub.Subscribe(ctx, postId), nil
 }
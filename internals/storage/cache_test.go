@@ -0,0 +1,372 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage/storagetest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewCache()
+	})
+}
+
+func TestCacheConcurrentPosts(t *testing.T) {
+	ctx := context.Background()
+	const posts, perPost = 8, 50
+
+	c := storage.NewCache()
+	alice, err := c.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	ids := make([]string, posts)
+	for i := range ids {
+		post, err := c.AddPost(ctx, alice.ID, "title", "text", true)
+		if err != nil {
+			t.Fatalf("AddPost: %v", err)
+		}
+		ids[i] = post.ID
+	}
+
+	// Every writer adds comments and replies to its own post, while readers check the trees
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+	for _, postId := range ids {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			top, err := c.AddComment(ctx, alice.ID, postId, postId, "top")
+			if err != nil {
+				t.Errorf("AddComment: %v", err)
+				return
+			}
+			for j := 1; j < perPost; j++ {
+				parentId := postId
+				if j%2 == 1 {
+					parentId = top.ID
+				}
+				if _, err := c.AddComment(ctx, alice.ID, postId, parentId, "text"); err != nil {
+					t.Errorf("AddComment: %v", err)
+				}
+			}
+		}()
+
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			seen := 0
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				tree, err := c.GetPost(ctx, postId, storage.WholeTree)
+				if err != nil {
+					t.Errorf("GetPost: %v", err)
+					return
+				}
+				n := countTree(t, tree.Comments)
+				if n < seen {
+					t.Errorf("post has %v comments after %v", n, seen)
+				}
+				seen = n
+			}
+		}()
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	for _, postId := range ids {
+		tree, err := c.GetPost(ctx, postId, storage.WholeTree)
+		if err != nil {
+			t.Fatalf("GetPost: %v", err)
+		}
+		if n := countTree(t, tree.Comments); n != perPost {
+			t.Errorf("post has %v comments, want %v", n, perPost)
+		}
+	}
+	if got := c.Stats().Comments; got != posts*perPost {
+		t.Errorf("cache has %v comments, want %v", got, posts*perPost)
+	}
+}
+
+func TestCacheReplyToOtherPost(t *testing.T) {
+	ctx := context.Background()
+	c := storage.NewCache()
+	alice, err := c.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	first, err := c.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	second, err := c.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	comment, err := c.AddComment(ctx, alice.ID, first.ID, first.ID, "text")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+
+	_, err = c.AddComment(ctx, alice.ID, second.ID, comment.ID, "text")
+	requireKind(t, err, storage.ErrValidation)
+}
+
+func TestCacheReadsAreCopies(t *testing.T) {
+	ctx := context.Background()
+	c := storage.NewCache()
+	alice, err := c.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	post, err := c.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	comment, err := c.AddComment(ctx, alice.ID, post.ID, post.ID, "text")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+
+	// Changes of returned entities don't reach the cache
+	post.Title = "changed"
+	comment.Text = "changed"
+	tree, err := c.GetPost(ctx, post.ID, storage.WholeTree)
+	if err != nil {
+		t.Fatalf("GetPost: %v", err)
+	}
+	tree.Comments[0].Text = "changed"
+	tree.Comments = nil
+	posts, err := c.GetAllPosts(ctx)
+	if err != nil {
+		t.Fatalf("GetAllPosts: %v", err)
+	}
+	posts[0].Text = "changed"
+	user, err := c.GetUser(ctx, alice.ID)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	user.Posts[0].Title = "changed"
+
+	tree, err = c.GetPost(ctx, post.ID, storage.WholeTree)
+	if err != nil {
+		t.Fatalf("GetPost: %v", err)
+	}
+	if tree.Title != "title" || tree.Text != "text" {
+		t.Errorf("post is changed through a returned copy: %+v", tree)
+	}
+	if len(tree.Comments) != 1 || tree.Comments[0].Text != "text" {
+		t.Errorf("comments are changed through a returned copy: %+v", tree.Comments)
+	}
+
+	// Returned entities don't change with the cache
+	title := "new title"
+	if _, err = c.UpdatePost(ctx, alice.ID, post.ID, &title, nil); err != nil {
+		t.Fatalf("UpdatePost: %v", err)
+	}
+	if _, err = c.UpdateComment(ctx, alice.ID, comment.ID, "new text"); err != nil {
+		t.Fatalf("UpdateComment: %v", err)
+	}
+	if tree.Title != "title" || tree.Comments[0].Text != "text" {
+		t.Errorf("returned post is changed by the cache: %+v", tree)
+	}
+}
+
+func TestCacheConcurrentReaders(t *testing.T) {
+	ctx := context.Background()
+	c := storage.NewCache()
+	alice, err := c.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	post, err := c.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	top, err := c.AddComment(ctx, alice.ID, post.ID, post.ID, "top")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+
+	// Readers serialize whatever they get while the writer changes the post, the race detector checks them
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				var results []any
+				tree, err := c.GetPost(ctx, post.ID, storage.WholeTree)
+				results = append(results, tree, err)
+				all, err := c.GetAllPosts(ctx)
+				results = append(results, all, err)
+				page, err := c.GetPosts(ctx, storage.Page{})
+				results = append(results, page, err)
+				comments, err := c.GetCommentsByPosts(ctx, []string{post.ID}, storage.Page{})
+				results = append(results, comments, err)
+				children, err := c.GetChildrenByComments(ctx, []string{top.ID}, storage.Page{})
+				results = append(results, children, err)
+				users, err := c.GetUsers(ctx)
+				results = append(results, users, err)
+				if _, err := json.Marshal(results); err != nil {
+					t.Errorf("unable to encode results: %v", err)
+				}
+				runtime.Gosched()
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		title := fmt.Sprintf("title %d", i)
+		if _, err = c.UpdatePost(ctx, alice.ID, post.ID, &title, nil); err != nil {
+			t.Errorf("UpdatePost: %v", err)
+		}
+		if _, err = c.AddComment(ctx, alice.ID, post.ID, top.ID, "reply"); err != nil {
+			t.Errorf("AddComment: %v", err)
+		}
+		if _, err = c.UpdateComment(ctx, alice.ID, top.ID, title); err != nil {
+			t.Errorf("UpdateComment: %v", err)
+		}
+		runtime.Gosched()
+	}
+}
+
+// countTree returns the number of comments in the tree, and fails the test if replies of a comment
+// don't match their count
+func countTree(t *testing.T, comments []*model.Comment) int {
+	t.Helper()
+	n := len(comments)
+	for _, comment := range comments {
+		if int(comment.ChildrenCount) != len(comment.Children) {
+			t.Errorf("comment: %v has %v replies, but its count is %v", comment.ID, len(comment.Children), comment.ChildrenCount)
+		}
+		n += countTree(t, comment.Children)
+	}
+	return n
+}
+
+// Run benchmarks with -cpu 1,2,4,8 to see how they scale with cores
+
+func BenchmarkCacheAddComment(b *testing.B) {
+	b.Run("SamePost", func(b *testing.B) {
+		benchmarkAddComment(b, false)
+	})
+	b.Run("DifferentPosts", func(b *testing.B) {
+		benchmarkAddComment(b, true)
+	})
+}
+
+// benchmarkAddComment adds comments from parallel goroutines, to one post or to a post of each goroutine
+func benchmarkAddComment(b *testing.B, different bool) {
+	ctx := context.Background()
+	c := storage.NewCache()
+	alice, err := c.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		b.Fatalf("AddUser: %v", err)
+	}
+	shared, err := c.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		b.Fatalf("AddPost: %v", err)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		postId := shared.ID
+		if different {
+			post, err := c.AddPost(ctx, alice.ID, "title", "text", true)
+			if err != nil {
+				b.Errorf("AddPost: %v", err)
+				return
+			}
+			postId = post.ID
+		}
+		for pb.Next() {
+			if _, err := c.AddComment(ctx, alice.ID, postId, postId, "text"); err != nil {
+				b.Errorf("AddComment: %v", err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkCacheGetPost(b *testing.B) {
+	ctx := context.Background()
+	const posts, perPost = 64, 20
+
+	c := storage.NewCache()
+	alice, err := c.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		b.Fatalf("AddUser: %v", err)
+	}
+	ids := make([]string, posts)
+	comments := make([]string, posts)
+	for i := range ids {
+		post, err := c.AddPost(ctx, alice.ID, "title", "text", true)
+		if err != nil {
+			b.Fatalf("AddPost: %v", err)
+		}
+		ids[i] = post.ID
+		for j := 0; j < perPost; j++ {
+			comment, err := c.AddComment(ctx, alice.ID, post.ID, post.ID, "text")
+			if err != nil {
+				b.Fatalf("AddComment: %v", err)
+			}
+			comments[i] = comment.ID
+		}
+	}
+
+	// Every tenth operation updates a comment of the post it reads, so the tree keeps its size
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := next.Add(1) % posts
+		for n := 0; pb.Next(); n++ {
+			var err error
+			if n%10 == 0 {
+				_, err = c.UpdateComment(ctx, alice.ID, comments[i], "new text")
+			} else {
+				_, err = c.GetPost(ctx, ids[i], storage.WholeTree)
+			}
+			if err != nil {
+				b.Errorf("operation on post: %v error: %v", ids[i], err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkCacheAddUser(b *testing.B) {
+	ctx := context.Background()
+	c := storage.NewCache()
+
+	// Uniqueness is checked with indexes, so it doesn't slow down as users are added
+	for i := 0; i < b.N; i++ {
+		name := fmt.Sprintf("user%d", i)
+		if _, err := c.AddUser(ctx, name, name+"@example.com"); err != nil {
+			b.Fatalf("AddUser: %v", err)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"io"
+	"sync"
+	"time"
+)
+
+// CachedStorageConfig configures CachedStorage
+type CachedStorageConfig struct {
+	// TTL is how long a result is served from memory
+	TTL time.Duration
+	// MaxEntries bounds the number of cached results, the least recently used one is evicted first
+	MaxEntries int
+	// ReplicaLag is how far replicas of the storage may be behind the primary, results read within it
+	// after a write may miss the write and are not cached. It is zero if the storage has no replicas.
+	ReplicaLag time.Duration
+}
+
+// CachedStorage is a read-through cache in front of another storage, it serves GetPost, GetAllPosts
+// and pages of comments from GetCommentsByPosts and GetChildrenByComments from memory, so a post and its comments
+// loaded level by level are read once. Writes go to the storage and invalidate cached results they change,
+// the session that has written reads past the cache, so the writer never reads a result older than its write.
+// Other methods go to the storage as they are. Callers get copies of cached results.
+type CachedStorage struct {
+	Storage
+	cfg CachedStorageConfig
+
+	m       sync.Mutex
+	entries map[cachedKey]*list.Element
+	// lru keeps *cachedEntry, the most recently used is at the front
+	lru *list.List
+	// gen changes on every invalidation, a result read before it is not cached
+	gen uint64
+	// fresh is the time replicas have the last write by, results read before it are not cached
+	fresh time.Time
+}
+
+// cachedKey is a key of GetPost result, of GetAllPosts result if all is set,
+// or of a page of comments of the post or of replies to the comment if page is set
+type cachedKey struct {
+	postId    string
+	maxDepth  int32
+	all       bool
+	commentId string
+	page      cachedPage
+}
+
+// cachedPage is Page as a comparable value, its values are set if their has flags are
+type cachedPage struct {
+	set                 bool
+	first, last         int32
+	hasFirst, hasLast   bool
+	after, before       string
+	hasAfter, hasBefore bool
+	sort                model.CommentSort
+}
+
+type cachedEntry struct {
+	key cachedKey
+	// postId is the post the result belongs to, it is empty for an empty page of replies
+	postId  string
+	post    *model.Post
+	posts   []*model.Post
+	page    *model.CommentConnection
+	expires time.Time
+}
+
+// NewCachedStorage returns store with read-through cache
+func NewCachedStorage(store Storage, cfg CachedStorageConfig) *CachedStorage {
+	return &CachedStorage{
+		Storage: store,
+		cfg:     cfg,
+		entries: make(map[cachedKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Close closes the storage if it can be closed
+func (s *CachedStorage) Close() error {
+	if closer, ok := s.Storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// GetPost returns post from memory, or reads it from the storage and keeps it for TTL
+func (s *CachedStorage) GetPost(ctx context.Context, postId string, maxDepth int32) (*model.Post, error) {
+	key := cachedKey{postId: postId, maxDepth: maxDepth}
+	entry, gen, keep := s.get(ctx, key)
+	if entry == nil {
+		post, err := s.Storage.GetPost(ctx, postId, maxDepth)
+		if err != nil {
+			return nil, err
+		}
+		entry = &cachedEntry{key: key, postId: postId, post: post}
+		if keep {
+			s.put(entry, gen)
+		}
+	}
+	return clonePost(entry.post), nil
+}
+
+// GetAllPosts returns all posts from memory, or reads them from the storage and keeps them for TTL
+func (s *CachedStorage) GetAllPosts(ctx context.Context) ([]*model.Post, error) {
+	key := cachedKey{all: true}
+	entry, gen, keep := s.get(ctx, key)
+	if entry == nil {
+		posts, err := s.Storage.GetAllPosts(ctx)
+		if err != nil {
+			return nil, err
+		}
+		entry = &cachedEntry{key: key, posts: posts}
+		if keep {
+			s.put(entry, gen)
+		}
+	}
+
+	posts := make([]*model.Post, len(entry.posts))
+	for i, post := range entry.posts {
+		posts[i] = clonePost(post)
+	}
+	return posts, nil
+}
+
+// GetCommentsByPosts returns pages of comments of posts from memory, and reads the rest from the storage
+func (s *CachedStorage) GetCommentsByPosts(ctx context.Context, postIds []string, page Page) (map[string]*model.CommentConnection, error) {
+	return s.getPages(ctx, postIds, page, func(id string, p cachedPage) cachedKey {
+		return cachedKey{postId: id, page: p}
+	}, s.Storage.GetCommentsByPosts)
+}
+
+// GetChildrenByComments returns pages of replies to comments from memory, and reads the rest from the storage
+func (s *CachedStorage) GetChildrenByComments(ctx context.Context, commentIds []string, page Page) (map[string]*model.CommentConnection, error) {
+	return s.getPages(ctx, commentIds, page, func(id string, p cachedPage) cachedKey {
+		return cachedKey{commentId: id, page: p}
+	}, s.Storage.GetChildrenByComments)
+}
+
+// getPages returns pages of ids from memory, and reads pages that aren't kept with one call of get.
+// Page belongs to the post of its comments, an empty page of replies belongs to no post.
+func (s *CachedStorage) getPages(ctx context.Context, ids []string, page Page, keyOf func(id string, p cachedPage) cachedKey,
+	get func(ctx context.Context, ids []string, page Page) (map[string]*model.CommentConnection, error),
+) (map[string]*model.CommentConnection, error) {
+	p := newCachedPage(page)
+	pages := make(map[string]*model.CommentConnection, len(ids))
+
+	var missing []string
+	var gen uint64
+	var keep bool
+	for _, id := range ids {
+		var entry *cachedEntry
+		if entry, gen, keep = s.get(ctx, keyOf(id, p)); entry != nil {
+			pages[id] = cloneConnection(entry.page)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return pages, nil
+	}
+
+	read, err := get(ctx, missing, page)
+	if err != nil {
+		return nil, err
+	}
+	for id, conn := range read {
+		key := keyOf(id, p)
+		postId := key.postId
+		if len(conn.Edges) > 0 {
+			postId = conn.Edges[0].Node.PostID
+		}
+		if keep {
+			s.put(&cachedEntry{key: key, postId: postId, page: conn}, gen)
+		}
+		pages[id] = cloneConnection(conn)
+	}
+	return pages, nil
+}
+
+// AddPost adds post to the storage and invalidates all posts
+func (s *CachedStorage) AddPost(ctx context.Context, userId string, title string, text string, allowComments bool) (*model.Post, error) {
+	MarkWritten(ctx)
+	defer s.invalidate("", true)
+	return s.Storage.AddPost(ctx, userId, title, text, allowComments)
+}
+
+// AddComment adds comment to the storage and invalidates its post
+func (s *CachedStorage) AddComment(ctx context.Context, userId, postId, parentId, text string) (*model.Comment, error) {
+	MarkWritten(ctx)
+	defer s.invalidate(postId, false)
+	return s.Storage.AddComment(ctx, userId, postId, parentId, text)
+}
+
+// UpdatePost updates post in the storage and invalidates it and all posts
+func (s *CachedStorage) UpdatePost(ctx context.Context, userId, postId string, title, text *string) (*model.Post, error) {
+	MarkWritten(ctx)
+	defer s.invalidate(postId, true)
+	return s.Storage.UpdatePost(ctx, userId, postId, title, text)
+}
+
+// DeletePost removes post from the storage and invalidates it and all posts
+func (s *CachedStorage) DeletePost(ctx context.Context, userId, postId string) error {
+	MarkWritten(ctx)
+	defer s.invalidate(postId, true)
+	return s.Storage.DeletePost(ctx, userId, postId)
+}
+
+// SetCommentsAllowed updates post in the storage and invalidates it and all posts
+func (s *CachedStorage) SetCommentsAllowed(ctx context.Context, userId, postId string, allowed bool, reason *string) (*model.Post, error) {
+	MarkWritten(ctx)
+	defer s.invalidate(postId, true)
+	return s.Storage.SetCommentsAllowed(ctx, userId, postId, allowed, reason)
+}
+
+// UpdateComment updates comment in the storage and invalidates its post
+func (s *CachedStorage) UpdateComment(ctx context.Context, userId, commentId, text string) (*model.Comment, error) {
+	MarkWritten(ctx)
+	comment, err := s.Storage.UpdateComment(ctx, userId, commentId, text)
+	if err != nil {
+		// Post of the comment is unknown, so every post is invalidated
+		s.invalidatePosts()
+		return nil, err
+	}
+	s.invalidate(comment.PostID, false)
+	return comment, nil
+}
+
+// VoteComment votes for comment in the storage and invalidates its post
+func (s *CachedStorage) VoteComment(ctx context.Context, userId, commentId string, value model.VoteValue) (*model.Comment, error) {
+	MarkWritten(ctx)
+	comment, err := s.Storage.VoteComment(ctx, userId, commentId, value)
+	if err != nil {
+		s.invalidatePosts()
+		return nil, err
+	}
+	s.invalidate(comment.PostID, false)
+	return comment, nil
+}
+
+// DeleteComment removes comment from the storage and invalidates every post, as post of the comment is unknown
+func (s *CachedStorage) DeleteComment(ctx context.Context, userId, commentId string) error {
+	MarkWritten(ctx)
+	defer s.invalidatePosts()
+	return s.Storage.DeleteComment(ctx, userId, commentId)
+}
+
+// get returns entry that is not expired, or nil and the generation to put a new entry with.
+// It returns nil for the session of ctx that has written, and false if a new entry must not be kept:
+// the session has written, or replicas may not have the last write yet.
+func (s *CachedStorage) get(ctx context.Context, key cachedKey) (*cachedEntry, uint64, bool) {
+	if HasWritten(ctx) {
+		return nil, 0, false
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	keep := !now.Before(s.fresh)
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, s.gen, keep
+	}
+	entry := elem.Value.(*cachedEntry)
+	if now.After(entry.expires) {
+		s.remove(elem)
+		return nil, s.gen, keep
+	}
+	s.lru.MoveToFront(elem)
+	return entry, s.gen, keep
+}
+
+// put keeps entry for TTL, unless there was an invalidation since gen, as entry may be older than the write.
+// The least recently used entries are evicted over MaxEntries.
+func (s *CachedStorage) put(entry *cachedEntry, gen uint64) {
+	if s.cfg.TTL <= 0 || s.cfg.MaxEntries <= 0 {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if gen != s.gen {
+		return
+	}
+	if elem, ok := s.entries[entry.key]; ok {
+		s.remove(elem)
+	}
+	entry.expires = time.Now().Add(s.cfg.TTL)
+	s.entries[entry.key] = s.lru.PushFront(entry)
+	for s.lru.Len() > s.cfg.MaxEntries {
+		s.remove(s.lru.Back())
+	}
+}
+
+// invalidate removes results of the post with pages of replies that belong to no post,
+// and the result of GetAllPosts if all is set
+func (s *CachedStorage) invalidate(postId string, all bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.written()
+	// There are at most MaxEntries entries, so they are just scanned
+	for key, elem := range s.entries {
+		entry := elem.Value.(*cachedEntry)
+		ofPost := postId != "" && (entry.postId == postId || (key.commentId != "" && entry.postId == ""))
+		if ofPost || (all && key.all) {
+			s.remove(elem)
+		}
+	}
+}
+
+// invalidatePosts removes results of every post
+func (s *CachedStorage) invalidatePosts() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.written()
+	for key, elem := range s.entries {
+		if !key.all {
+			s.remove(elem)
+		}
+	}
+}
+
+// written starts a new generation, and waits for replicas to get the write before results are kept again.
+// The lock must be held.
+func (s *CachedStorage) written() {
+	s.gen++
+	s.fresh = time.Now().Add(s.cfg.ReplicaLag)
+}
+
+// remove removes the entry of elem
+func (s *CachedStorage) remove(elem *list.Element) {
+	s.lru.Remove(elem)
+	delete(s.entries, elem.Value.(*cachedEntry).key)
+}
+
+// newCachedPage returns page as a key
+func newCachedPage(page Page) cachedPage {
+	p := cachedPage{set: true, sort: page.Sort}
+	if page.First != nil {
+		p.first, p.hasFirst = *page.First, true
+	}
+	if page.Last != nil {
+		p.last, p.hasLast = *page.Last, true
+	}
+	if page.After != nil {
+		p.after, p.hasAfter = *page.After, true
+	}
+	if page.Before != nil {
+		p.before, p.hasBefore = *page.Before, true
+	}
+	return p
+}
+
+// clonePost returns a copy of the post with copies of its loaded comments
+func clonePost(post *model.Post) *model.Post {
+	p := *post
+	p.Comments = cloneComments(post.Comments)
+	return &p
+}
+
+// cloneComments returns copies of comments with copies of their loaded replies
+func cloneComments(comments []*model.Comment) []*model.Comment {
+	if comments == nil {
+		return nil
+	}
+	clones := make([]*model.Comment, len(comments))
+	for i, comment := range comments {
+		c := *comment
+		c.Children = cloneComments(comment.Children)
+		clones[i] = &c
+	}
+	return clones
+}
+
+// cloneConnection returns a copy of the page with copies of its comments
+func cloneConnection(conn *model.CommentConnection) *model.CommentConnection {
+	c := *conn
+	c.Edges = make([]*model.CommentEdge, len(conn.Edges))
+	for i, edge := range conn.Edges {
+		node := *edge.Node
+		node.Children = cloneComments(edge.Node.Children)
+		c.Edges[i] = &model.CommentEdge{Cursor: edge.Cursor, Node: &node}
+	}
+	if conn.PageInfo != nil {
+		info := *conn.PageInfo
+		c.PageInfo = &info
+	}
+	return &c
+}
@@ -0,0 +1,309 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage/storagetest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachedStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return storage.NewCachedStorage(storage.NewCache(), storage.CachedStorageConfig{TTL: time.Minute, MaxEntries: 100})
+	})
+}
+
+func TestCachedStorageReads(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStorage{Storage: storage.NewCache()}
+	s := storage.NewCachedStorage(backend, storage.CachedStorageConfig{TTL: time.Minute, MaxEntries: 2})
+
+	alice, err := s.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	var posts []*model.Post
+	for i := 0; i < 3; i++ {
+		post, err := s.AddPost(ctx, alice.ID, "title", "text", true)
+		if err != nil {
+			t.Fatalf("AddPost: %v", err)
+		}
+		posts = append(posts, post)
+	}
+
+	// Repeated reads are served from memory
+	getPost(t, s, posts[0].ID)
+	getPost(t, s, posts[0].ID)
+	backend.requireReads(t, 1)
+
+	// The post is invalidated by a new comment, the reader sees it at once
+	comment, err := s.AddComment(ctx, alice.ID, posts[0].ID, posts[0].ID, "text")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+	if got := getPost(t, s, posts[0].ID); len(got.Comments) != 1 {
+		t.Errorf("post has %v comments after AddComment, want 1", len(got.Comments))
+	}
+	backend.requireReads(t, 2)
+
+	// And by a vote for its comment
+	if _, err = s.VoteComment(ctx, alice.ID, comment.ID, model.VoteValueUp); err != nil {
+		t.Fatalf("VoteComment: %v", err)
+	}
+	if got := getPost(t, s, posts[0].ID); got.Comments[0].Score() != 1 {
+		t.Errorf("comment has score %v after VoteComment, want 1", got.Comments[0].Score())
+	}
+	backend.requireReads(t, 3)
+
+	// Only two posts are kept, the least recently used one is evicted
+	getPost(t, s, posts[1].ID)
+	getPost(t, s, posts[2].ID)
+	getPost(t, s, posts[0].ID)
+	backend.requireReads(t, 6)
+	getPost(t, s, posts[2].ID)
+	backend.requireReads(t, 6)
+
+	all, err := s.GetAllPosts(ctx)
+	if err != nil {
+		t.Fatalf("GetAllPosts: %v", err)
+	}
+	if len(all) != 3 {
+		t.Errorf("GetAllPosts returned %v posts, want 3", len(all))
+	}
+	if _, err = s.AddPost(ctx, alice.ID, "title", "text", true); err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	if all, err = s.GetAllPosts(ctx); err != nil || len(all) != 4 {
+		t.Errorf("GetAllPosts returned %v posts after AddPost, want 4, error: %v", len(all), err)
+	}
+}
+
+func TestCachedStorageTTL(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStorage{Storage: storage.NewCache()}
+	s := storage.NewCachedStorage(backend, storage.CachedStorageConfig{TTL: 20 * time.Millisecond, MaxEntries: 10})
+
+	alice, err := s.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	post, err := s.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+
+	getPost(t, s, post.ID)
+	getPost(t, s, post.ID)
+	backend.requireReads(t, 1)
+
+	time.Sleep(40 * time.Millisecond)
+	getPost(t, s, post.ID)
+	backend.requireReads(t, 2)
+}
+
+func TestCachedStorageSession(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStorage{Storage: storage.NewCache()}
+	s := storage.NewCachedStorage(backend, storage.CachedStorageConfig{
+		TTL:        time.Minute,
+		MaxEntries: 10,
+		ReplicaLag: 20 * time.Millisecond,
+	})
+
+	alice, err := s.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	post, err := s.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+
+	// Session that has written reads past the cache
+	session := storage.WithSession(ctx)
+	if _, err = s.AddComment(session, alice.ID, post.ID, post.ID, "text"); err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if got, err := s.GetPost(session, post.ID, storage.WholeTree); err != nil || len(got.Comments) != 1 {
+			t.Fatalf("GetPost in the session returned %+v, error: %v", got, err)
+		}
+	}
+	backend.requireReads(t, 2)
+
+	// Replicas may miss the write for ReplicaLag, what is read within it isn't kept
+	getPost(t, s, post.ID)
+	getPost(t, s, post.ID)
+	backend.requireReads(t, 4)
+
+	time.Sleep(40 * time.Millisecond)
+	getPost(t, s, post.ID)
+	getPost(t, s, post.ID)
+	backend.requireReads(t, 5)
+}
+
+func TestCachedStoragePages(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStorage{Storage: storage.NewCache()}
+	s := storage.NewCachedStorage(backend, storage.CachedStorageConfig{TTL: time.Minute, MaxEntries: 10})
+
+	alice, err := s.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	post, err := s.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	comment, err := s.AddComment(ctx, alice.ID, post.ID, post.ID, "text")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+
+	// Comments of the post and replies to them are read once
+	getComments(t, s, post.ID)
+	getComments(t, s, post.ID)
+	getChildren(t, s, comment.ID)
+	getChildren(t, s, comment.ID)
+	backend.requirePageReads(t, 2)
+
+	// Empty page of replies is invalidated by the first reply
+	reply, err := s.AddComment(ctx, alice.ID, post.ID, comment.ID, "reply")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+	if got := getChildren(t, s, comment.ID); len(got.Edges) != 1 {
+		t.Errorf("comment has %v replies after AddComment, want 1", len(got.Edges))
+	}
+	if got := getComments(t, s, post.ID); got.Edges[0].Node.ChildrenCount != 1 {
+		t.Errorf("comment has %v replies count after AddComment, want 1", got.Edges[0].Node.ChildrenCount)
+	}
+	backend.requirePageReads(t, 4)
+
+	// And pages of the post are invalidated by votes and edits
+	if _, err = s.VoteComment(ctx, alice.ID, reply.ID, model.VoteValueUp); err != nil {
+		t.Fatalf("VoteComment: %v", err)
+	}
+	if got := getChildren(t, s, comment.ID); got.Edges[0].Node.Score() != 1 {
+		t.Errorf("reply has score %v after VoteComment, want 1", got.Edges[0].Node.Score())
+	}
+	if _, err = s.UpdateComment(ctx, alice.ID, comment.ID, "edited"); err != nil {
+		t.Fatalf("UpdateComment: %v", err)
+	}
+	if got := getComments(t, s, post.ID); got.Edges[0].Node.Text != "edited" {
+		t.Errorf("comment has text %q after UpdateComment, want %q", got.Edges[0].Node.Text, "edited")
+	}
+	backend.requirePageReads(t, 6)
+
+	// Callers get copies, so they can't change cached results
+	getComments(t, s, post.ID).Edges[0].Node.Text = "changed"
+	if got := getComments(t, s, post.ID); got.Edges[0].Node.Text != "edited" {
+		t.Errorf("cached comment has text %q, want %q", got.Edges[0].Node.Text, "edited")
+	}
+	getPost(t, s, post.ID).Comments[0].Children[0].Text = "changed"
+	if got := getPost(t, s, post.ID); got.Comments[0].Children[0].Text != "reply" {
+		t.Errorf("cached reply has text %q, want %q", got.Comments[0].Children[0].Text, "reply")
+	}
+	backend.requirePageReads(t, 6)
+
+	if err = s.DeleteComment(ctx, alice.ID, reply.ID); err != nil {
+		t.Fatalf("DeleteComment: %v", err)
+	}
+	if got := getChildren(t, s, comment.ID); len(got.Edges) != 0 {
+		t.Errorf("comment has %v replies after DeleteComment, want 0", len(got.Edges))
+	}
+	backend.requirePageReads(t, 7)
+}
+
+func TestCachedStorageInvalidPage(t *testing.T) {
+	ctx := context.Background()
+	s := storage.NewCachedStorage(storage.NewCache(), storage.CachedStorageConfig{TTL: time.Minute, MaxEntries: 10})
+
+	alice, err := s.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	post, err := s.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+
+	// Cached default page is not served for invalid arguments
+	getComments(t, s, post.ID)
+	negative, empty := int32(-1), ""
+	_, err = s.GetCommentsByPosts(ctx, []string{post.ID}, storage.Page{First: &negative})
+	if !errors.Is(err, storage.ErrValidation) {
+		t.Errorf("GetCommentsByPosts with negative first returned error: %v, want %v", err, storage.ErrValidation)
+	}
+	_, err = s.GetCommentsByPosts(ctx, []string{post.ID}, storage.Page{After: &empty})
+	if !errors.Is(err, storage.ErrValidation) {
+		t.Errorf("GetCommentsByPosts with empty cursor returned error: %v, want %v", err, storage.ErrValidation)
+	}
+}
+
+// countingStorage counts reads of posts and of pages of comments
+type countingStorage struct {
+	storage.Storage
+	reads     atomic.Int32
+	pageReads atomic.Int32
+}
+
+func (s *countingStorage) GetPost(ctx context.Context, postId string, maxDepth int32) (*model.Post, error) {
+	s.reads.Add(1)
+	return s.Storage.GetPost(ctx, postId, maxDepth)
+}
+
+func (s *countingStorage) GetCommentsByPosts(ctx context.Context, postIds []string, page storage.Page) (map[string]*model.CommentConnection, error) {
+	s.pageReads.Add(1)
+	return s.Storage.GetCommentsByPosts(ctx, postIds, page)
+}
+
+func (s *countingStorage) GetChildrenByComments(ctx context.Context, commentIds []string, page storage.Page) (map[string]*model.CommentConnection, error) {
+	s.pageReads.Add(1)
+	return s.Storage.GetChildrenByComments(ctx, commentIds, page)
+}
+
+func (s *countingStorage) requirePageReads(t *testing.T, want int32) {
+	t.Helper()
+	if got := s.pageReads.Load(); got != want {
+		t.Errorf("pages are read %v times, want %v", got, want)
+	}
+}
+
+func (s *countingStorage) requireReads(t *testing.T, want int32) {
+	t.Helper()
+	if got := s.reads.Load(); got != want {
+		t.Errorf("storage is read %v times, want %v", got, want)
+	}
+}
+
+func getPost(t *testing.T, s storage.Storage, postId string) *model.Post {
+	t.Helper()
+	post, err := s.GetPost(context.Background(), postId, storage.WholeTree)
+	if err != nil {
+		t.Fatalf("GetPost: %v", err)
+	}
+	return post
+}
+
+func getComments(t *testing.T, s storage.Storage, postId string) *model.CommentConnection {
+	t.Helper()
+	pages, err := s.GetCommentsByPosts(context.Background(), []string{postId}, storage.Page{})
+	if err != nil {
+		t.Fatalf("GetCommentsByPosts: %v", err)
+	}
+	return pages[postId]
+}
+
+func getChildren(t *testing.T, s storage.Storage, commentId string) *model.CommentConnection {
+	t.Helper()
+	pages, err := s.GetChildrenByComments(context.Background(), []string{commentId}, storage.Page{})
+	if err != nil {
+		t.Fatalf("GetChildrenByComments: %v", err)
+	}
+	return pages[commentId]
+}
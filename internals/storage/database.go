@@ -2,46 +2,66 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"log"
-	"strconv"
-	"time"
+	"strings"
 )
 
 const (
-	defaultHost         = "localhost"
-	sslmodeDisable      = "disable"
-	poolMaxConn         = "10"
-	poolMaxConnLifetime = "1h30m"
+	defaultHost    = "localhost"
+	sslmodeDisable = "disable"
 )
 
+// PostgresStorage writes to the primary DB, and reads posts from replicas if they are set
 type PostgresStorage struct {
+	sqlStorage
 	DB *pgxpool.Pool
 }
 
-// NewPostgresStorage returns PostgresStorage structure with *pgxpool.Pool inside
-func NewPostgresStorage(username, password, port, database string) (*PostgresStorage, error) {
+// NewPostgresStorage returns PostgresStorage structure with *pgxpool.Pool of the primary inside
+// and pools of replicas from cfg
+func NewPostgresStorage(cfg PostgresConfig) (*PostgresStorage, error) {
 
 	// Connecting to database
-	pool, err := PostgresConn(username, password, port, database)
+	pool, err := PostgresConn(cfg)
 	if err != nil {
 		return nil, err
 	}
 	log.Println("Postgres is connected")
-	return &PostgresStorage{DB: pool}, nil
+
+	s := &PostgresStorage{DB: pool}
+	s.db, s.dialect, s.hub = pgxConn{pgxDB{pool}, pool}, postgresDialect, NewCommentHub()
+	s.maxDepth.Store(DefaultMaxCommentDepth)
+	if len(cfg.Replicas) > 0 {
+		if s.replicas, err = newReplicaSet(cfg); err != nil {
+			pool.Close()
+			return nil, err
+		}
+		log.Printf("Postgres has %v replicas", len(cfg.Replicas))
+	}
+	return s, nil
 }
 
-// PostgresConn connects to database, pings and returns this connection
-func PostgresConn(username, password, port, database string) (*pgxpool.Pool, error) {
+// NewPostgresStorageFromDSN returns PostgresStorage connected to database with the connection string
+func NewPostgresStorageFromDSN(dsn string) (*PostgresStorage, error) {
+	return NewPostgresStorage(PostgresConfig{DSN: dsn})
+}
+
+// PostgresConn connects to the primary database, pings and returns this connection
+func PostgresConn(cfg PostgresConfig) (*pgxpool.Pool, error) {
 	const op = "storage.database.PostgresConn"
 
-	dbUrl := fmt.Sprintf("user=%s password=%s host=%s port=%s dbname=%s sslmode=%s pool_max_conns=%s pool_max_conn_lifetime=%s",
-		username, password, defaultHost, port, database, sslmodeDisable, poolMaxConn, poolMaxConnLifetime)
+	poolCfg, err := cfg.poolConfig(cfg.dsn())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
 
 	// New Pool
-	db, err := pgxpool.New(context.Background(), dbUrl)
+	db, err := pgxpool.NewWithConfig(context.Background(), poolCfg)
 	if err != nil {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
@@ -49,262 +69,106 @@ func PostgresConn(username, password, port, database string) (*pgxpool.Pool, err
 	// Check if connection is ok
 	err = db.Ping(context.Background())
 	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("ping error %s: %w", op, err)
 	}
 	return db, nil
 }
 
-// GetPost returns post via id, or return error if there is no such post
-func (s *PostgresStorage) GetPost(postId string) (*model.Post, error) {
-	const op = "storage.database.GetPost"
-
-	post := &model.Post{
-		ID: postId,
-	}
-
-	// Getting post data from database
-	err := s.DB.QueryRow(context.Background(), `SELECT user_id, title, body, permission FROM posts 
-                        WHERE id = $1 `, postId).Scan(&post.UserID, &post.Title, &post.Text, &post.AllowComments)
-	if err != nil {
-		return nil, fmt.Errorf("unable to get post at %s: %w", op, err)
-	}
-
-	// Getting all comments related to post
-	rows, err := s.DB.Query(context.Background(), `SELECT id, user_id, parent_id, body, created_at 
-						FROM comments WHERE post_id = $1`, postId)
-	if err != nil {
-		return nil, fmt.Errorf("unable to get comments at %s: %w", op, err)
-	}
-	defer rows.Close()
-	for rows.Next() {
-
-		comment := &model.Comment{
-			PostID: post.ID,
-		}
-		createdAt := time.Time{}
-
-		if err = rows.Scan(&comment.ID, &comment.UserID, &comment.ParentID, &comment.Text, &createdAt); err != nil {
-			return nil, fmt.Errorf("unable to scan row at %s: %w", op, err)
-		}
-		comment.CreatedAt = fmt.Sprintf("%v", createdAt)
-		post.Comments = append(post.Comments, comment)
-	}
-
-	return post, nil
+// PostgresConnDSN connects to database with the connection string, pings and returns this connection
+func PostgresConnDSN(dsn string) (*pgxpool.Pool, error) {
+	return PostgresConn(PostgresConfig{DSN: dsn})
 }
 
-// GetAllPosts returns all posts from database
-func (s *PostgresStorage) GetAllPosts() ([]*model.Post, error) {
-	const op = "storage.database.GetAllPost"
-
-	rows, err := s.DB.Query(context.Background(), `SELECT * FROM posts`)
-	if err != nil {
-		return nil, fmt.Errorf("unable to get all posts at %s: %w", op, err)
-	}
-	defer rows.Close()
-
-	var posts []*model.Post
-
-	for rows.Next() {
-
-		post := &model.Post{}
-		if err = rows.Scan(&post.ID, &post.UserID, &post.Title, &post.Text, &post.AllowComments); err != nil {
-			return nil, fmt.Errorf("unable to scan posts at %s: %w", op, err)
-		}
-
-		if post.AllowComments {
-			rowsComments, err := s.DB.Query(context.Background(), `SELECT * FROM comments WHERE post_id = $1`, post.ID)
-
-			if err != nil {
-				return nil, fmt.Errorf("unable to get all commmets to post: %s, at %s: %w", post.ID, op, err)
-			}
-			defer rowsComments.Close()
-
-			var comments []*model.Comment
-
-			for rowsComments.Next() {
-				comment := &model.Comment{}
-				createdAt := time.Time{}
-				if err = rowsComments.Scan(&comment.ID, &comment.UserID, &comment.PostID,
-					&comment.ParentID, &comment.Text, &createdAt); err != nil {
-					return nil, fmt.Errorf("unable to scan comment at %s: %w", op, err)
-				}
-				comment.CreatedAt = fmt.Sprintf("%v", createdAt)
-
-				rowsChildren, err := s.DB.Query(context.Background(), `SELECT * FROM comments WHERE parent_id = $1`,
-					comment.ID)
-				if err != nil {
-					return nil, fmt.Errorf("unable to get comments children: %s, at %s: %w", comment.ID, op, err)
-				}
-				defer rowsChildren.Close()
-
-				var children []*model.Comment
+// postgresDialect passes lists of keys as arrays and orders comment trees by arrays of ids
+var postgresDialect = &dialect{
+	in: func(column string, n int) string {
+		return fmt.Sprintf("%s = ANY($%d)", column, n)
+	},
+	keys:       func(keys []int64) any { return keys },
+	rootPath:   `ARRAY[id]`,
+	childPath:  `t.path || c.id`,
+	forUpdate:  ` FOR UPDATE`,
+	forShare:   ` FOR SHARE`,
+	constraint: constraintViolation,
+}
 
-				for rowsChildren.Next() {
-					childComment := &model.Comment{}
-					childCreatedAt := time.Time{}
-					if err = rowsChildren.Scan(&childComment.ID, &childComment.UserID, &childComment.PostID,
-						&childComment.ParentID, &childComment.Text, &childCreatedAt); err != nil {
-						return nil, fmt.Errorf("unable to scan childComment at %s: %w", op, err)
-					}
-					childComment.CreatedAt = fmt.Sprintf("%v", childCreatedAt)
-					children = append(children, childComment)
-				}
-				comments = append(comments, comment)
-			}
+// Codes of postgres errors
+var violationCodes = map[violation]string{
+	foreignKeyViolation: "23503",
+	uniqueViolation:     "23505",
+}
 
-			post.Comments = comments
-		}
-		posts = append(posts, post)
-	}
-	return posts, nil
+// Suffixes of names of constraints that postgres gives them by default
+var violationSuffixes = map[violation]string{
+	foreignKeyViolation: "_fkey",
+	uniqueViolation:     "_key",
 }
 
-func (s *PostgresStorage) AddUser(name, email string) (*model.User, error) {
-	const op = "storage.database.AddUser"
-	tx, err := s.DB.Begin(context.Background())
-	if err != nil {
-		return nil, fmt.Errorf("%w", err)
-	}
-	defer func() {
-		err = tx.Rollback(context.Background())
-		if err != nil {
-			log.Printf("Rollback at %s error: %v", op, err)
-		}
-	}()
-	user := &model.User{
-		Username: name,
-		Email:    email,
-		Posts:    []*model.Post{},
-	}
-	err = tx.QueryRow(context.Background(), `INSERT INTO users (username, email) VALUES ($1, $2) RETURNING id`,
-		name, email).Scan(&user.ID)
-	if err != nil {
-		return nil, fmt.Errorf("unable to add user at %s: %w", op, err)
-	}
-	err = tx.Commit(context.Background())
-	if err != nil {
-		return nil, fmt.Errorf("unable to commit insertion at %s: %w", op, err)
+// constraintViolation returns "table.column" of the constraint if err is postgres error of the kind,
+// otherwise empty string. Constraints are named table_column_key or table_column_fkey.
+func constraintViolation(err error, kind violation) string {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != violationCodes[kind] {
+		return ""
 	}
+	column := strings.TrimPrefix(pgErr.ConstraintName, pgErr.TableName+"_")
+	return pgErr.TableName + "." + strings.TrimSuffix(column, violationSuffixes[kind])
+}
 
-	return user, nil
+// pgxQuerier is a pool, a connection or a transaction of pgx
+type pgxQuerier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
 }
 
-func (s *PostgresStorage) AddPost(userId string, title string, text string, allowComments bool) (*model.Post, error) {
-	const op = "storage.database.AddPost"
-	tx, err := s.DB.Begin(context.Background())
-	if err != nil {
-		return nil, fmt.Errorf("%w", err)
-	}
-	defer func() {
-		err = tx.Rollback(context.Background())
-		if err != nil {
-			log.Printf("Rollback at %s error: %v", op, err)
-		}
-	}()
-	post := &model.Post{
-		Title:         title,
-		Text:          text,
-		UserID:        userId,
-		Comments:      []*model.Comment{},
-		AllowComments: allowComments,
-	}
+// pgxDB is querier over pgx
+type pgxDB struct {
+	db pgxQuerier
+}
 
-	intUserId, err := strconv.Atoi(userId)
-	if err != nil {
-		return nil, fmt.Errorf("unable to convert user id %s to int at %s: %w", userId, op, err)
-	}
-	err = tx.QueryRow(context.Background(), `INSERT INTO posts (user_id, title, body, permission) 
-												VALUES ($1, $2, $3, $4) RETURNING id`,
-		intUserId, title, text, allowComments).Scan(&post.ID)
-	if err != nil {
-		return nil, fmt.Errorf("unable to add user at %s: %w", op, err)
-	}
+func (d pgxDB) Query(ctx context.Context, query string, args ...any) (rows, error) {
+	return d.db.Query(ctx, query, args...)
+}
 
-	err = tx.Commit(context.Background())
-	if err != nil {
-		return nil, fmt.Errorf("unable to commit insertion at %s: %w", op, err)
-	}
-	return post, nil
+func (d pgxDB) QueryRow(ctx context.Context, query string, args ...any) row {
+	return d.db.QueryRow(ctx, query, args...)
 }
 
-func (s *PostgresStorage) AddComment(userId, postId, parentId, text string) (*model.Comment, error) {
-	const op = "storage.database.AddComment"
+func (d pgxDB) Exec(ctx context.Context, query string, args ...any) error {
+	_, err := d.db.Exec(ctx, query, args...)
+	return err
+}
 
-	var permission bool
-	err := s.DB.QueryRow(context.Background(), "SELECT permission FROM posts WHERE id = $1", postId).Scan(&permission)
-	if err != nil {
-		return nil, fmt.Errorf("unable to check if post: %v has a permission to add comments %s: %w", postId, op, err)
-	}
-	if !permission {
-		return nil, fmt.Errorf("unable to add comment: %v has no permission to add comments %s: %w", postId, op, err)
-	}
-	tx, err := s.DB.Begin(context.Background())
-	if err != nil {
-		return nil, fmt.Errorf("%w", err)
-	}
-	defer func() {
-		err = tx.Rollback(context.Background())
-		if err != nil {
-			log.Printf("Rollback at %s error: %v", op, err)
-		}
-	}()
+// pgxConn is conn over a pool of pgx
+type pgxConn struct {
+	pgxDB
+	pool *pgxpool.Pool
+}
 
-	intUserId, err := strconv.Atoi(userId)
-	if err != nil {
-		return nil, fmt.Errorf("unable to convert user id %s to int at %s: %w", userId, op, err)
-	}
-	intPostId, err := strconv.Atoi(postId)
+func (c pgxConn) Begin(ctx context.Context) (tx, error) {
+	t, err := c.pool.Begin(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("unable to convert post id %s to int at %s: %w", postId, op, err)
+		return nil, err
 	}
-	createdAt := time.Now()
+	return pgxTx{pgxDB{t}, t}, nil
+}
 
-	if parentId == postId {
-		comment := &model.Comment{
-			UserID:    userId,
-			PostID:    postId,
-			ParentID:  postId,
-			Text:      text,
-			CreatedAt: fmt.Sprintf("%v", createdAt),
-			Children:  []*model.Comment{},
-		}
-		err = tx.QueryRow(context.Background(), `INSERT INTO comments (user_id, post_id, parent_id, body, created_at) 
-												VALUES ($1, $2, $3, $4, $5) RETURNING id`,
-			intUserId, intPostId, intPostId, text, createdAt).Scan(&comment.ID)
-		if err != nil {
-			return nil, fmt.Errorf("unable to add comment at %s: %w", op, err)
-		}
-		err = tx.Commit(context.Background())
-		if err != nil {
-			return nil, fmt.Errorf("unable to commit insertion at %s: %w", op, err)
-		}
-		return comment, nil
+// pgxTx is tx over a transaction of pgx
+type pgxTx struct {
+	pgxDB
+	tx pgx.Tx
+}
 
-	}
+func (t pgxTx) Commit(ctx context.Context) error {
+	return t.tx.Commit(ctx)
+}
 
-	intParentId, err := strconv.Atoi(parentId)
-	if err != nil {
-		return nil, fmt.Errorf("unable to convert parent id %s to int at %s: %w", parentId, op, err)
-	}
-	comment := &model.Comment{
-		UserID:    userId,
-		PostID:    postId,
-		ParentID:  parentId,
-		Text:      text,
-		CreatedAt: fmt.Sprintf("%v", createdAt),
-		Children:  []*model.Comment{},
+func (t pgxTx) Rollback() error {
+	err := t.tx.Rollback(context.Background())
+	if errors.Is(err, pgx.ErrTxClosed) {
+		return nil
 	}
-	err = tx.QueryRow(context.Background(), `INSERT INTO comments (user_id, post_id, parent_id, body, created_at) 
-											VALUES ($1, $2, $3, $4, $5) RETURNING id`,
-		intUserId, intPostId, intParentId, text, createdAt).Scan(&comment.ID)
-	if err != nil {
-		return nil, fmt.Errorf("unable to add user at %s: %w", op, err)
-	}
-	err = tx.Commit(context.Background())
-	if err != nil {
-		return nil, fmt.Errorf("unable to commit insertion at %s: %w", op, err)
-	}
-
-	return comment, nil
+	return err
 }
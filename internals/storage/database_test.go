@@ -0,0 +1,67 @@
+package storage_test
+
+import (
+	"context"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage/storagetest"
+	"os"
+	"testing"
+)
+
+// postgresDSNEnv is the env variable with connection string to a local database,
+// the suite applies migrations to it and truncates its tables
+const postgresDSNEnv = "STORAGE_TEST_POSTGRES_DSN"
+
+func TestPostgresStorage(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, err := storage.NewPostgresStorageFromDSN(dsn)
+		if err != nil {
+			t.Fatalf("NewPostgresStorageFromDSN: %v", err)
+		}
+		t.Cleanup(s.DB.Close)
+
+		if _, err = s.MigrateUp(context.Background()); err != nil {
+			t.Fatalf("MigrateUp: %v", err)
+		}
+		_, err = s.DB.Exec(context.Background(), `TRUNCATE users, posts, comments RESTART IDENTITY CASCADE`)
+		if err != nil {
+			t.Fatalf("unable to truncate tables: %v", err)
+		}
+		return s
+	})
+}
+
+func TestPostgresStorageReplicas(t *testing.T) {
+	dsn := os.Getenv(postgresDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", postgresDSNEnv)
+	}
+
+	// The database is its own replica, and an unreachable replica is skipped
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, err := storage.NewPostgresStorage(storage.PostgresConfig{
+			DSN:      dsn,
+			Replicas: []string{dsn, "host=127.0.0.1 port=1 connect_timeout=1", dsn},
+		})
+		if err != nil {
+			t.Fatalf("NewPostgresStorage: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = s.Close()
+		})
+
+		if _, err = s.MigrateUp(context.Background()); err != nil {
+			t.Fatalf("MigrateUp: %v", err)
+		}
+		_, err = s.DB.Exec(context.Background(), `TRUNCATE users, posts, comments RESTART IDENTITY CASCADE`)
+		if err != nil {
+			t.Fatalf("unable to truncate tables: %v", err)
+		}
+		return s
+	})
+}
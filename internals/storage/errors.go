@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Kinds of errors returned by both storages, check them with errors.Is
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrConflict         = errors.New("conflict")
+	ErrValidation       = errors.New("validation failed")
+	ErrForbidden        = errors.New("forbidden")
+	ErrCommentsDisabled = errors.New("comments disabled")
+	ErrDeadlineExceeded = errors.New("deadline exceeded")
+	ErrCanceled         = errors.New("canceled")
+	ErrInternal         = errors.New("internal error")
+)
+
+// Error is an error of one of the kinds above, its message is the message of the wrapped error
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns both the kind and the wrapped error, so errors.Is works for each of them
+func (e *Error) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// NewError creates an error of the kind with formatted message, %w verb can be used to wrap the cause
+func NewError(kind error, format string, args ...any) error {
+	return &Error{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// internalError wraps err as internal, errors of the context get their own kinds.
+// Errors that already have a kind are returned as they are.
+func internalError(format string, args ...any) error {
+	err := fmt.Errorf(format, args...)
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return &Error{Kind: ErrDeadlineExceeded, Err: err}
+	case errors.Is(err, context.Canceled):
+		return &Error{Kind: ErrCanceled, Err: err}
+	}
+	return &Error{Kind: ErrInternal, Err: err}
+}
+
+// checkContext returns error if ctx is done, so the operation isn't started after the deadline
+func checkContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return internalError("operation is stopped: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"context"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"sync"
+)
+
+const (
+	// subscriberBuffer is how many comments can wait for a slow subscriber,
+	// after that new comments for this subscriber are dropped
+	subscriberBuffer = 16
+)
+
+// CommentHub delivers new comments to everyone who subscribed to the post
+type CommentHub struct {
+	subscribers map[string]map[chan *model.Comment]struct{}
+	m           sync.RWMutex
+}
+
+// NewCommentHub creates a new hub instance
+func NewCommentHub() *CommentHub {
+	return &CommentHub{
+		subscribers: make(map[string]map[chan *model.Comment]struct{}),
+	}
+}
+
+// Subscribe returns a channel with new comments to the post.
+// The channel is closed when ctx is done.
+func (h *CommentHub) Subscribe(ctx context.Context, postId string) <-chan *model.Comment {
+	ch := make(chan *model.Comment, subscriberBuffer)
+
+	h.m.Lock()
+	if h.subscribers[postId] == nil {
+		h.subscribers[postId] = make(map[chan *model.Comment]struct{})
+	}
+	h.subscribers[postId][ch] = struct{}{}
+	h.m.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		h.unsubscribe(postId, ch)
+	}()
+
+	return ch
+}
+
+// Publish sends comment to all subscribers of its post. It never blocks,
+// if subscriber's buffer is full the comment is skipped for this subscriber
+func (h *CommentHub) Publish(comment *model.Comment) {
+	h.m.RLock()
+	defer h.m.RUnlock()
+
+	for ch := range h.subscribers[comment.PostID] {
+		select {
+		case ch <- comment:
+		default:
+		}
+	}
+}
+
+// unsubscribe removes the channel from subscribers and closes it
+func (h *CommentHub) unsubscribe(postId string, ch chan *model.Comment) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	delete(h.subscribers[postId], ch)
+	if len(h.subscribers[postId]) == 0 {
+		delete(h.subscribers, postId)
+	}
+	close(ch)
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"log"
+)
+
+const (
+	// entryOverhead approximates memory of an entity besides its strings: the struct, map entries and slices
+	entryOverhead = 256
+	// voteOverhead approximates memory of a vote besides id of its user
+	voteOverhead = 32
+)
+
+// CacheLimits bound the memory of Cache, zero value of a limit means no limit.
+// Users are never evicted, but they count towards MaxBytes.
+type CacheLimits struct {
+	// MaxEntries bounds the number of posts and comments
+	MaxEntries int `json:"maxEntries"`
+	// MaxBytes bounds the approximate size of all users, posts and comments
+	MaxBytes int64 `json:"maxBytes"`
+}
+
+// CacheStats is the size of Cache and the number of evicted entities since it was created
+type CacheStats struct {
+	Users           int         `json:"users"`
+	Posts           int         `json:"posts"`
+	Comments        int         `json:"comments"`
+	Bytes           int64       `json:"bytes"`
+	EvictedPosts    int64       `json:"evictedPosts"`
+	EvictedComments int64       `json:"evictedComments"`
+	Limits          CacheLimits `json:"limits"`
+}
+
+// SetLimits sets limits of the cache, and evicts posts over them
+func (c *Cache) SetLimits(limits CacheLimits) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.limits = limits
+	c.evict("")
+}
+
+// Stats returns the size of the cache and the number of evictions
+func (c *Cache) Stats() CacheStats {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	return CacheStats{
+		Users:           len(c.UserCache),
+		Posts:           len(c.PostsCache),
+		Comments:        int(c.commentCount.Load()),
+		Bytes:           c.bytes.Load(),
+		EvictedPosts:    c.evictedPosts,
+		EvictedComments: c.evictedComments,
+		Limits:          c.limits,
+	}
+}
+
+// shrink evicts posts over the limits like evict, it takes the write lock only if the cache is over them.
+// It is called by writers that hold the read lock, after they release it.
+func (c *Cache) shrink(keepId string) {
+	c.m.RLock()
+	over := c.overLimits()
+	c.m.RUnlock()
+	if !over {
+		return
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.evict(keepId)
+}
+
+// evict removes the oldest posts with all their comments while the cache is over the limits.
+// The post with keepId is being written, so it is never evicted. Write lock of the cache must be held.
+func (c *Cache) evict(keepId string) {
+	for c.overLimits() {
+		i := 0
+		if len(c.postsOrder) > 0 && c.postsOrder[0].ID == keepId {
+			i = 1
+		}
+		if i >= len(c.postsOrder) {
+			return
+		}
+		post := c.postsOrder[i]
+
+		// Eviction is written to the log, so the post doesn't come back after restart
+		if err := c.record(&logRecord{Op: opEvictPost, ID: post.ID}); err != nil {
+			log.Printf("Eviction of post: %v error: %v", post.ID, err)
+			return
+		}
+		comments := c.commentCount.Load()
+		c.applyDeletePost(post)
+		c.evictedPosts++
+		c.evictedComments += comments - c.commentCount.Load()
+	}
+}
+
+// overLimits returns true if the cache has more entries or bytes than its limits
+func (c *Cache) overLimits() bool {
+	if c.limits.MaxEntries > 0 && int64(len(c.PostsCache))+c.commentCount.Load() > int64(c.limits.MaxEntries) {
+		return true
+	}
+	return c.limits.MaxBytes > 0 && c.bytes.Load() > c.limits.MaxBytes
+}
+
+// userSize returns approximate memory of the user
+func userSize(user *model.User) int64 {
+	return int64(entryOverhead + len(user.ID) + len(user.Username) + len(user.Email))
+}
+
+// postSize returns approximate memory of the post without its comments
+func postSize(post *model.Post) int64 {
+	size := entryOverhead + len(post.ID) + len(post.UserID) + len(post.Title) + len(post.Text)
+	if post.CommentsClosedReason != nil {
+		size += len(*post.CommentsClosedReason)
+	}
+	return int64(size)
+}
+
+// commentSize returns approximate memory of the comment without its replies
+func commentSize(comment *model.Comment) int64 {
+	return int64(entryOverhead + len(comment.ID) + len(comment.UserID) + len(comment.PostID) +
+		len(comment.ParentID) + len(comment.Text) + len(comment.Cursor))
+}
+
+// voteSize returns approximate memory of a vote of the user
+func voteSize(userId string) int64 {
+	return int64(voteOverhead + len(userId))
+}
@@ -0,0 +1,165 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"strings"
+	"testing"
+)
+
+func TestCacheMaxEntries(t *testing.T) {
+	ctx := context.Background()
+	c := storage.NewCache()
+	c.SetLimits(storage.CacheLimits{MaxEntries: 4})
+
+	alice, err := c.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	first, err := c.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	top, err := c.AddComment(ctx, alice.ID, first.ID, first.ID, "text")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+	if _, err = c.AddComment(ctx, alice.ID, first.ID, top.ID, "text"); err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+	second, err := c.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	requireStats(t, c, storage.CacheStats{Users: 1, Posts: 2, Comments: 2})
+
+	// The oldest post is evicted with its comments
+	if _, err = c.AddPost(ctx, alice.ID, "title", "text", true); err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	requireStats(t, c, storage.CacheStats{Users: 1, Posts: 2, EvictedPosts: 1, EvictedComments: 2})
+	_, err = c.GetPost(ctx, first.ID, storage.WholeTree)
+	requireKind(t, err, storage.ErrNotFound)
+	if user, err := c.GetUser(ctx, alice.ID); err != nil || len(user.Posts) != 2 {
+		t.Errorf("user has posts %v after eviction, want 2, error: %v", user.Posts, err)
+	}
+
+	// The post being commented stays, though it is the oldest one
+	for i := 0; i < 3; i++ {
+		if _, err = c.AddComment(ctx, alice.ID, second.ID, second.ID, "text"); err != nil {
+			t.Fatalf("AddComment: %v", err)
+		}
+	}
+	requireStats(t, c, storage.CacheStats{Users: 1, Posts: 1, Comments: 3, EvictedPosts: 2, EvictedComments: 2})
+	if _, err = c.GetPost(ctx, second.ID, storage.WholeTree); err != nil {
+		t.Errorf("GetPost: %v", err)
+	}
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	c := storage.NewCache()
+
+	alice, err := c.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	empty := c.Stats().Bytes
+
+	// Size returns to the same after everything is removed
+	post, err := c.AddPost(ctx, alice.ID, "title", strings.Repeat("a", 1000), true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	top, err := c.AddComment(ctx, alice.ID, post.ID, post.ID, "text")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+	reply, err := c.AddComment(ctx, alice.ID, post.ID, top.ID, "text")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+	if _, err = c.UpdateComment(ctx, alice.ID, reply.ID, strings.Repeat("b", 500)); err != nil {
+		t.Fatalf("UpdateComment: %v", err)
+	}
+	if _, err = c.VoteComment(ctx, alice.ID, reply.ID, model.VoteValueUp); err != nil {
+		t.Fatalf("VoteComment: %v", err)
+	}
+	if err = c.DeleteComment(ctx, alice.ID, top.ID); err != nil {
+		t.Fatalf("DeleteComment: %v", err)
+	}
+	if got := c.Stats().Bytes; got < empty+1500 {
+		t.Errorf("cache has %v bytes, want at least %v", got, empty+1500)
+	}
+	if err = c.DeleteComment(ctx, alice.ID, reply.ID); err != nil {
+		t.Fatalf("DeleteComment: %v", err)
+	}
+	if err = c.DeletePost(ctx, alice.ID, post.ID); err != nil {
+		t.Fatalf("DeletePost: %v", err)
+	}
+	if got := c.Stats().Bytes; got != empty {
+		t.Errorf("cache has %v bytes after removing everything, want %v", got, empty)
+	}
+
+	// Big posts push out the old ones
+	c.SetLimits(storage.CacheLimits{MaxBytes: empty + 3000})
+	for i := 0; i < 5; i++ {
+		if _, err = c.AddPost(ctx, alice.ID, "title", strings.Repeat("a", 1000), true); err != nil {
+			t.Fatalf("AddPost: %v", err)
+		}
+	}
+	stats := c.Stats()
+	if stats.Bytes > stats.Limits.MaxBytes {
+		t.Errorf("cache has %v bytes over the limit %v", stats.Bytes, stats.Limits.MaxBytes)
+	}
+	if stats.Posts+int(stats.EvictedPosts) != 5 || stats.EvictedPosts == 0 {
+		t.Errorf("cache has %v posts and %v evicted, want 5 in sum", stats.Posts, stats.EvictedPosts)
+	}
+}
+
+func TestPersistentCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c := openCache(t, dir)
+	c.SetLimits(storage.CacheLimits{MaxEntries: 1})
+
+	alice, err := c.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	first, err := c.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	if _, err = c.AddPost(ctx, alice.ID, "title", "text", true); err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+
+	// Evicted post doesn't come back after restart
+	restored := openCache(t, dir)
+	_, err = restored.GetPost(ctx, first.ID, 0)
+	requireKind(t, err, storage.ErrNotFound)
+	if got := restored.Stats().Posts; got != 1 {
+		t.Errorf("restored cache has %v posts, want 1", got)
+	}
+}
+
+// requireStats fails the test if stats of the cache have other counts, bytes and limits are not compared
+func requireStats(t *testing.T, c *storage.Cache, want storage.CacheStats) {
+	t.Helper()
+	got := c.Stats()
+	got.Bytes, got.Limits = 0, storage.CacheLimits{}
+	if got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+}
+
+// requireKind fails the test if err is not of the kind
+func requireKind(t *testing.T, err, kind error) {
+	t.Helper()
+	if !errors.Is(err, kind) {
+		t.Errorf("got error: %v, want %v", err, kind)
+	}
+}
@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/KaffeeMaschina/ozon_test_task/migrations"
+	sqlitemigrations "github.com/KaffeeMaschina/ozon_test_task/migrations/sqlite"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/pressly/goose/v3"
+	"io/fs"
+)
+
+// MigrationStatus is the state of one embedded migration in database
+type MigrationStatus = goose.MigrationStatus
+
+// MigrateUp applies all pending embedded migrations, and returns versions of applied ones
+func (s *PostgresStorage) MigrateUp(ctx context.Context) ([]int64, error) {
+	const op = "storage.migrate.MigrateUp"
+
+	var versions []int64
+	err := s.withMigrations(func(p *goose.Provider) error {
+		results, err := p.Up(ctx)
+		for _, result := range results {
+			if result.Error == nil {
+				versions = append(versions, result.Source.Version)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return versions, fmt.Errorf("unable to apply migrations at %s: %w", op, err)
+	}
+	return versions, nil
+}
+
+// MigrateDown rolls back the last applied migration, and returns its version
+func (s *PostgresStorage) MigrateDown(ctx context.Context) (int64, error) {
+	const op = "storage.migrate.MigrateDown"
+
+	var version int64
+	err := s.withMigrations(func(p *goose.Provider) error {
+		result, err := p.Down(ctx)
+		if result != nil {
+			version = result.Source.Version
+		}
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to roll back migration at %s: %w", op, err)
+	}
+	return version, nil
+}
+
+// MigrationStatuses returns states of all embedded migrations in the order they are applied
+func (s *PostgresStorage) MigrationStatuses(ctx context.Context) ([]*MigrationStatus, error) {
+	const op = "storage.migrate.MigrationStatuses"
+
+	var statuses []*MigrationStatus
+	err := s.withMigrations(func(p *goose.Provider) error {
+		var err error
+		statuses, err = p.Status(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get migrations status at %s: %w", op, err)
+	}
+	return statuses, nil
+}
+
+// CheckSchemaVersion returns schema version of database and version of the last embedded migration.
+// It returns error if database has a version newer than the server knows, so the server can't work with it.
+func (s *PostgresStorage) CheckSchemaVersion(ctx context.Context) (current, latest int64, err error) {
+	const op = "storage.migrate.CheckSchemaVersion"
+
+	err = s.withMigrations(func(p *goose.Provider) error {
+		current, latest, err = p.GetVersions(ctx)
+		return err
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to get schema version at %s: %w", op, err)
+	}
+	if current > latest {
+		return current, latest, fmt.Errorf("schema version: %v of database is newer than the latest known: %v",
+			current, latest)
+	}
+	return current, latest, nil
+}
+
+// withMigrations runs f with goose provider of the embedded migrations over the pool of the storage
+func (s *PostgresStorage) withMigrations(f func(p *goose.Provider) error) error {
+	db := stdlib.OpenDBFromPool(s.DB)
+	defer func(db *sql.DB) {
+		_ = db.Close()
+	}(db)
+
+	return withProvider(db, goose.DialectPostgres, migrations.FS, f)
+}
+
+// migrate applies pending embedded migrations of sqlite, or returns error if the database file
+// has a schema version newer than the server knows
+func (s *SQLiteStorage) migrate(ctx context.Context) error {
+	const op = "storage.migrate.migrate"
+
+	return withProvider(s.DB, goose.DialectSQLite3, sqlitemigrations.FS, func(p *goose.Provider) error {
+		current, latest, err := p.GetVersions(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to get schema version at %s: %w", op, err)
+		}
+		if current > latest {
+			return fmt.Errorf("schema version: %v of database is newer than the latest known: %v",
+				current, latest)
+		}
+		if _, err = p.Up(ctx); err != nil {
+			return fmt.Errorf("unable to apply migrations at %s: %w", op, err)
+		}
+		return nil
+	})
+}
+
+// withProvider runs f with goose provider of migrations from fsys over db
+func withProvider(db *sql.DB, dialect goose.Dialect, fsys fs.FS, f func(p *goose.Provider) error) error {
+	p, err := goose.NewProvider(dialect, db, fsys)
+	if err != nil {
+		return err
+	}
+	return f(p)
+}
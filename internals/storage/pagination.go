@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+	cursorPrefix    = "cursor:"
+)
+
+// Page is a Relay-style request for a part of a connection.
+// Only one of First and Last may be set, if none is set defaultPageSize is used.
+// Sort is the order of comments, OLDEST if it is empty, pages of posts ignore it.
+type Page struct {
+	First  *int32
+	After  *string
+	Last   *int32
+	Before *string
+	Sort   model.CommentSort
+}
+
+// pageBounds is a validated page with decoded cursors
+type pageBounds struct {
+	limit     int
+	backward  bool
+	after     int64
+	hasAfter  bool
+	before    int64
+	hasBefore bool
+}
+
+// bounds validates the page and decodes its cursors
+func (p Page) bounds() (pageBounds, error) {
+	var b pageBounds
+
+	if p.First != nil && p.Last != nil {
+		return b, NewError(ErrValidation, "first and last can't be used together")
+	}
+
+	b.limit = defaultPageSize
+	switch {
+	case p.First != nil:
+		if *p.First < 0 {
+			return b, NewError(ErrValidation, "first: %v can't be negative", *p.First)
+		}
+		b.limit = int(*p.First)
+	case p.Last != nil:
+		if *p.Last < 0 {
+			return b, NewError(ErrValidation, "last: %v can't be negative", *p.Last)
+		}
+		b.limit = int(*p.Last)
+		b.backward = true
+	}
+	if b.limit > maxPageSize {
+		b.limit = maxPageSize
+	}
+
+	var err error
+	if p.After != nil {
+		if b.after, err = decodeCursor(*p.After); err != nil {
+			return b, err
+		}
+		b.hasAfter = true
+	}
+	if p.Before != nil {
+		if b.before, err = decodeCursor(*p.Before); err != nil {
+			return b, err
+		}
+		b.hasBefore = true
+	}
+	return b, nil
+}
+
+// commentOrder is the order of comments of a sort: by their keys ascending, or descending if desc is set.
+// The last key is the key of id, so keys of different comments differ.
+type commentOrder struct {
+	// columns are SQL expressions of the keys
+	columns []string
+	desc    bool
+	// keys returns the keys of the comment, id is the key of its id
+	keys func(comment *model.Comment, id int64) []int64
+}
+
+// minorityVotes is SQL expression of the smaller of upvotes and downvotes of a comment
+const minorityVotes = `CASE WHEN upvotes < downvotes THEN upvotes ELSE downvotes END`
+
+// commentOrders are orders of comments by sort. Ties of TOP and CONTROVERSIAL go to newer comments.
+// CONTROVERSIAL puts first comments with most votes on the minority side, then with most votes.
+var commentOrders = map[model.CommentSort]commentOrder{
+	model.CommentSortOldest: {
+		columns: []string{"id"},
+		keys:    func(_ *model.Comment, id int64) []int64 { return []int64{id} },
+	},
+	model.CommentSortNewest: {
+		columns: []string{"id"},
+		desc:    true,
+		keys:    func(_ *model.Comment, id int64) []int64 { return []int64{id} },
+	},
+	model.CommentSortTop: {
+		columns: []string{"upvotes - downvotes", "id"},
+		desc:    true,
+		keys: func(comment *model.Comment, id int64) []int64 {
+			return []int64{int64(comment.Score()), id}
+		},
+	},
+	model.CommentSortControversial: {
+		columns: []string{minorityVotes, "upvotes + downvotes", "id"},
+		desc:    true,
+		keys: func(comment *model.Comment, id int64) []int64 {
+			return []int64{int64(min(comment.Upvotes, comment.Downvotes)),
+				int64(comment.Upvotes) + int64(comment.Downvotes), id}
+		},
+	},
+}
+
+// compare compares keys a and b of comments in the order
+func (o commentOrder) compare(a, b []int64) int {
+	if o.desc {
+		return slices.Compare(b, a)
+	}
+	return slices.Compare(a, b)
+}
+
+// sqlAfter returns SQL condition that selects comments after the cursor, keys of the cursor are parameters
+// numbered from n, placeholder formats the number of a parameter
+func (o commentOrder) sqlAfter(placeholder string, n int) string {
+	params := make([]string, len(o.columns))
+	for i := range params {
+		params[i] = fmt.Sprintf(placeholder, n+i)
+	}
+	op := " > "
+	if o.desc {
+		op = " < "
+	}
+	return "(" + strings.Join(o.columns, ", ") + ")" + op + "(" + strings.Join(params, ", ") + ")"
+}
+
+// sqlOrderBy returns SQL list of ORDER BY of the order
+func (o commentOrder) sqlOrderBy() string {
+	columns := make([]string, len(o.columns))
+	for i, column := range o.columns {
+		columns[i] = column
+		if o.desc {
+			columns[i] += " DESC"
+		}
+	}
+	return strings.Join(columns, ", ")
+}
+
+// commentBounds is a validated page of comments with its order and keys of its cursor, after is nil if it is not set
+type commentBounds struct {
+	limit int
+	sort  model.CommentSort
+	order commentOrder
+	after []int64
+}
+
+// commentBounds validates the page of comments and decodes its cursor
+func (p Page) commentBounds() (commentBounds, error) {
+	by := p.Sort
+	if by == "" {
+		by = model.CommentSortOldest
+	}
+	order, ok := commentOrders[by]
+	if !ok {
+		return commentBounds{}, NewError(ErrValidation, "Sort: %v is not valid", p.Sort)
+	}
+	b, err := Page{First: p.First, Last: p.Last}.bounds()
+	if err != nil {
+		return commentBounds{}, err
+	}
+
+	cb := commentBounds{limit: b.limit, sort: by, order: order}
+	if p.After != nil {
+		if cb.after, err = decodeCommentCursor(by, *p.After, len(order.columns)); err != nil {
+			return commentBounds{}, err
+		}
+	}
+	return cb, nil
+}
+
+// encodeCursor makes an opaque cursor from the sort key of an item
+func encodeCursor(key int64) string {
+	return base64.URLEncoding.EncodeToString([]byte(cursorPrefix + strconv.FormatInt(key, 10)))
+}
+
+// decodeCursor returns sort key from the cursor, or returns error if the cursor is malformed
+func decodeCursor(cursor string) (int64, error) {
+	raw, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), cursorPrefix) {
+		return 0, NewError(ErrValidation, "Cursor: %v is invalid", cursor)
+	}
+	key, err := strconv.ParseInt(strings.TrimPrefix(string(raw), cursorPrefix), 10, 64)
+	if err != nil {
+		return 0, NewError(ErrValidation, "Cursor: %v is invalid", cursor)
+	}
+	return key, nil
+}
+
+// encodeCommentCursor makes an opaque cursor from keys of a comment in the sort,
+// cursors of OLDEST are cursors of comments
+func encodeCommentCursor(by model.CommentSort, keys []int64) string {
+	if by == model.CommentSortOldest {
+		return encodeCursor(keys[0])
+	}
+	parts := make([]string, 0, len(keys)+1)
+	parts = append(parts, string(by))
+	for _, key := range keys {
+		parts = append(parts, strconv.FormatInt(key, 10))
+	}
+	return base64.URLEncoding.EncodeToString([]byte(cursorPrefix + strings.Join(parts, ":")))
+}
+
+// decodeCommentCursor returns n keys of a comment in the sort from the cursor,
+// or returns error if the cursor is malformed or belongs to another sort
+func decodeCommentCursor(by model.CommentSort, cursor string, n int) ([]int64, error) {
+	if by == model.CommentSortOldest {
+		key, err := decodeCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		return []int64{key}, nil
+	}
+
+	raw, err := base64.URLEncoding.DecodeString(cursor)
+	prefix := cursorPrefix + string(by) + ":"
+	if err != nil || !strings.HasPrefix(string(raw), prefix) {
+		return nil, NewError(ErrValidation, "Cursor: %v is invalid", cursor)
+	}
+	parts := strings.Split(strings.TrimPrefix(string(raw), prefix), ":")
+	if len(parts) != n {
+		return nil, NewError(ErrValidation, "Cursor: %v is invalid", cursor)
+	}
+	keys := make([]int64, n)
+	for i, part := range parts {
+		if keys[i], err = strconv.ParseInt(part, 10, 64); err != nil {
+			return nil, NewError(ErrValidation, "Cursor: %v is invalid", cursor)
+		}
+	}
+	return keys, nil
+}
+
+// PageComments cuts a page from preloaded comments, that are sorted oldest first and have cursors
+func PageComments(comments []*model.Comment, page Page) (*model.CommentConnection, error) {
+	b, err := page.commentBounds()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]int64, len(comments))
+	for i, comment := range comments {
+		if keys[i], err = decodeCursor(comment.Cursor); err != nil {
+			return nil, err
+		}
+	}
+	return commentsPage(comments, b, func(i int) int64 { return keys[i] }), nil
+}
+
+// commentsPage cuts a page in the order of b from comments sorted oldest first, id returns the key of id
+// of the i-th comment. Pages of OLDEST and NEWEST are found by binary search, other sorts sort the comments.
+func commentsPage(comments []*model.Comment, b commentBounds, id func(i int) int64) *model.CommentConnection {
+	n := len(comments)
+
+	// at returns the index in comments of the i-th comment in the order
+	at := func(i int) int { return i }
+	switch b.sort {
+	case model.CommentSortOldest:
+	case model.CommentSortNewest:
+		at = func(i int) int { return n - 1 - i }
+	default:
+		keys := make([][]int64, n)
+		perm := make([]int, n)
+		for i, comment := range comments {
+			keys[i] = b.order.keys(comment, id(i))
+			perm[i] = i
+		}
+		slices.SortFunc(perm, func(x, y int) int { return b.order.compare(keys[x], keys[y]) })
+		at = func(i int) int { return perm[i] }
+	}
+	keys := func(i int) []int64 {
+		j := at(i)
+		return b.order.keys(comments[j], id(j))
+	}
+
+	from := 0
+	if b.after != nil {
+		from = sort.Search(n, func(i int) bool {
+			return b.order.compare(keys(i), b.after) > 0
+		})
+	}
+	to := min(from+b.limit, n)
+
+	edges := make([]*model.CommentEdge, 0, to-from)
+	for i := from; i < to; i++ {
+		edges = append(edges, &model.CommentEdge{
+			Cursor: encodeCommentCursor(b.sort, keys(i)),
+			Node:   comments[at(i)],
+		})
+	}
+
+	return &model.CommentConnection{
+		Edges:      edges,
+		PageInfo:   newPageInfo(len(edges), func(i int) string { return edges[i].Cursor }, to < n, from > 0),
+		TotalCount: int32(n),
+	}
+}
+
+// newPageInfo fills page info, cursor returns the cursor of the i-th of n edges of the page
+func newPageInfo(n int, cursor func(i int) string, hasNext, hasPrevious bool) *model.PageInfo {
+	info := &model.PageInfo{
+		HasNextPage:     hasNext,
+		HasPreviousPage: hasPrevious,
+	}
+	if n > 0 {
+		start, end := cursor(0), cursor(n-1)
+		info.StartCursor = &start
+		info.EndCursor = &end
+	}
+	return info
+}
@@ -0,0 +1,501 @@
+package storage
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/globalid"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy tells when mutations written to the log of persistent cache are flushed to disk
+type FsyncPolicy string
+
+const (
+	// FsyncAlways flushes every mutation before it is applied, nothing is lost on crash
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncInterval flushes the log periodically, mutations of the last interval can be lost on crash of the machine
+	FsyncInterval FsyncPolicy = "interval"
+	// FsyncNever leaves flushing to the operating system
+	FsyncNever FsyncPolicy = "never"
+)
+
+const (
+	snapshotFileName     = "snapshot.json"
+	logFileName          = "log.jsonl"
+	defaultFsyncInterval = time.Second
+)
+
+// PersistenceConfig configures persistence of Cache
+type PersistenceConfig struct {
+	// Dir keeps the snapshot and the log, it is created if it doesn't exist
+	Dir   string
+	Fsync FsyncPolicy
+	// FsyncInterval is the period of flushing with FsyncInterval policy, one second by default
+	FsyncInterval time.Duration
+	// SnapshotInterval is the period of compacting the log into the snapshot,
+	// if it is zero the snapshot is written only on Close
+	SnapshotInterval time.Duration
+}
+
+// Operations of the cache written to the log
+type logOp string
+
+const (
+	opAddUser       logOp = "addUser"
+	opAddPost       logOp = "addPost"
+	opAddComment    logOp = "addComment"
+	opUpdatePost    logOp = "updatePost"
+	opDeletePost    logOp = "deletePost"
+	opUpdateComment logOp = "updateComment"
+	opDeleteComment logOp = "deleteComment"
+	opEvictPost     logOp = "evictPost"
+	opVoteComment   logOp = "voteComment"
+)
+
+// logRecord is one mutation of the cache, it has the resulting state of the entity,
+// so replaying it gives the same ids and times
+type logRecord struct {
+	LSN     int64          `json:"lsn"`
+	Op      logOp          `json:"op"`
+	User    *model.User    `json:"user,omitempty"`
+	Post    *model.Post    `json:"post,omitempty"`
+	Comment *model.Comment `json:"comment,omitempty"`
+	Vote    *commentVote   `json:"vote,omitempty"`
+	ID      string         `json:"id,omitempty"`
+	At      *time.Time     `json:"at,omitempty"`
+}
+
+// commentVote is the vote of the user for the comment, value 0 takes the vote back
+type commentVote struct {
+	CommentID string `json:"commentId"`
+	UserID    string `json:"userId"`
+	Value     int8   `json:"value"`
+}
+
+// cacheSnapshot is the state of the cache after the record with LSN,
+// entities are in the order they were added, so parents come before their children
+type cacheSnapshot struct {
+	LSN      int64            `json:"lsn"`
+	LastSeq  int64            `json:"lastSeq"`
+	Users    []*model.User    `json:"users"`
+	Posts    []*model.Post    `json:"posts"`
+	Comments []*model.Comment `json:"comments"`
+	Votes    []*commentVote   `json:"votes,omitempty"`
+}
+
+// cacheLog is the append-only log of the persistent cache
+type cacheLog struct {
+	cfg  PersistenceConfig
+	mu   sync.Mutex
+	file *os.File
+	// size is the size of the log without a failed write, lsn is the number of the last written record
+	size  int64
+	lsn   int64
+	dirty bool
+
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// NewPersistentCache creates a cache that loads the snapshot and replays the log from cfg.Dir,
+// and writes every mutation to the log. Close it to write the snapshot and flush the log.
+func NewPersistentCache(cfg PersistenceConfig) (*Cache, error) {
+	const op = "storage.persistence.NewPersistentCache"
+
+	switch cfg.Fsync {
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy: %q at %s, use %s, %s or %s", cfg.Fsync, op,
+			FsyncAlways, FsyncInterval, FsyncNever)
+	}
+	if cfg.FsyncInterval <= 0 {
+		cfg.FsyncInterval = defaultFsyncInterval
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("unable to create directory at %s: %w", op, err)
+	}
+
+	c := NewCache()
+	lsn, err := c.loadSnapshot(filepath.Join(cfg.Dir, snapshotFileName))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load snapshot at %s: %w", op, err)
+	}
+	lsn, size, err := c.replayLog(filepath.Join(cfg.Dir, logFileName), lsn)
+	if err != nil {
+		return nil, fmt.Errorf("unable to replay log at %s: %w", op, err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(cfg.Dir, logFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open log at %s: %w", op, err)
+	}
+	if err = syncDir(cfg.Dir); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("unable to sync directory at %s: %w", op, err)
+	}
+
+	l := &cacheLog{cfg: cfg, file: file, size: size, lsn: lsn, stop: make(chan struct{})}
+	c.persist = l
+	if cfg.Fsync == FsyncInterval {
+		l.every(cfg.FsyncInterval, l.sync)
+	}
+	if cfg.SnapshotInterval > 0 {
+		l.every(cfg.SnapshotInterval, c.snapshot)
+	}
+	return c, nil
+}
+
+// Close stops background flushing, writes the snapshot and closes the log.
+// Cache without persistence has nothing to close.
+func (c *Cache) Close() error {
+	const op = "storage.persistence.Close"
+
+	l := c.persist
+	if l == nil {
+		return nil
+	}
+
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.stop)
+		l.wg.Wait()
+
+		if err = c.snapshot(); err != nil {
+			err = fmt.Errorf("unable to write snapshot at %s: %w", op, err)
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		err = errors.Join(err, l.file.Sync(), l.file.Close())
+		l.file = nil
+	})
+	return err
+}
+
+// record writes the mutation to the log before it is applied, persistent cache returns error
+// if the mutation can't be written, so it is not applied
+func (c *Cache) record(rec *logRecord) error {
+	if c.persist == nil {
+		return nil
+	}
+	return c.persist.write(rec)
+}
+
+// write appends the record to the log and flushes it if the policy is FsyncAlways
+func (l *cacheLog) write(rec *logRecord) error {
+	const op = "storage.persistence.write"
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return internalError("unable to write log at %s: log is closed", op)
+	}
+	rec.LSN = l.lsn + 1
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return internalError("unable to encode record at %s: %w", op, err)
+	}
+	data = append(data, '\n')
+
+	// A failed record is cut off, so the next record starts on a new line
+	if _, err = l.file.Write(data); err == nil && l.cfg.Fsync == FsyncAlways {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		_ = l.file.Truncate(l.size)
+		return internalError("unable to write log at %s: %w", op, err)
+	}
+
+	l.lsn = rec.LSN
+	l.size += int64(len(data))
+	l.dirty = true
+	return nil
+}
+
+// sync flushes records written since the last flush
+func (l *cacheLog) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil || !l.dirty {
+		return nil
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+// every runs f periodically until the log is closed
+func (l *cacheLog) every(interval time.Duration, f func() error) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				if err := f(); err != nil {
+					log.Printf("Persistence of cache error: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// snapshot writes the state of the cache to the snapshot file and truncates the log,
+// the snapshot replaces the old one only when it is completely written
+func (c *Cache) snapshot() error {
+	// Read locks are enough, mutations are written to the log under the write lock of the cache or of the post
+	c.m.RLock()
+	defer c.m.RUnlock()
+	for i := range c.stripes {
+		c.stripes[i].RLock()
+		defer c.stripes[i].RUnlock()
+	}
+
+	l := c.persist
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	snap := cacheSnapshot{
+		LSN:      l.lsn,
+		LastSeq:  c.lastSeq.Load(),
+		Users:    make([]*model.User, 0, len(c.usersOrder)),
+		Posts:    c.postsOrder,
+		Comments: make([]*model.Comment, 0, c.commentCount.Load()),
+	}
+	for _, user := range c.usersOrder {
+		// Posts of users are restored from posts
+		u := *user
+		u.Posts = nil
+		snap.Users = append(snap.Users, &u)
+	}
+	var comments []*cachedComment
+	c.comments.Range(func(_, v any) bool {
+		comments = append(comments, v.(*cachedComment))
+		return true
+	})
+	slices.SortFunc(comments, func(a, b *cachedComment) int {
+		return cmp.Compare(a.seq, b.seq)
+	})
+	for _, comment := range comments {
+		snap.Comments = append(snap.Comments, comment.comment)
+		for _, userId := range slices.Sorted(maps.Keys(comment.votes)) {
+			snap.Votes = append(snap.Votes, &commentVote{
+				CommentID: comment.comment.ID,
+				UserID:    userId,
+				Value:     comment.votes[userId],
+			})
+		}
+	}
+
+	if err := writeFileAtomic(filepath.Join(l.cfg.Dir, snapshotFileName), snap); err != nil {
+		return err
+	}
+
+	// Records of the log are in the snapshot now
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	l.size = 0
+	l.dirty = false
+	return l.file.Sync()
+}
+
+// loadSnapshot restores the cache from the snapshot file and returns LSN of the last record in it,
+// a missing file is an empty cache
+func (c *Cache) loadSnapshot(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var snap cacheSnapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return 0, err
+	}
+
+	for _, user := range snap.Users {
+		seq, err := globalid.Decode(globalid.User, user.ID)
+		if err != nil {
+			return 0, err
+		}
+		c.applyAddUser(user, seq)
+	}
+	for _, post := range snap.Posts {
+		seq, err := globalid.Decode(globalid.Post, post.ID)
+		if err != nil {
+			return 0, err
+		}
+		c.applyAddPost(post, seq)
+	}
+	for _, comment := range snap.Comments {
+		seq, err := globalid.Decode(globalid.Comment, comment.ID)
+		if err != nil {
+			return 0, err
+		}
+		// Replies and votes are counted again when they are added
+		comment.ChildrenCount = 0
+		comment.Upvotes, comment.Downvotes = 0, 0
+		c.applyAddComment(comment, seq)
+	}
+	for _, vote := range snap.Votes {
+		if cc, ok := c.cached(vote.CommentID); ok {
+			c.applyVote(cc, vote.UserID, vote.Value)
+		}
+	}
+	c.seenSeq(snap.LastSeq)
+	return snap.LSN, nil
+}
+
+// replayLog applies records of the log after the record with LSN lsn, and returns LSN of the last record
+// and the size of complete records. Incomplete last record is left by a crash during the write, it is cut off.
+func (c *Cache) replayLog(path string, lsn int64) (int64, int64, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return lsn, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	var size int64
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("Incomplete record at the end of %s is cut off", path)
+				if err = file.Truncate(size); err != nil {
+					return 0, 0, err
+				}
+			}
+			return lsn, size, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		var rec logRecord
+		if err = json.Unmarshal(line, &rec); err != nil {
+			return 0, 0, fmt.Errorf("record at offset %v: %w", size, err)
+		}
+		if rec.LSN > lsn {
+			if err = c.apply(&rec); err != nil {
+				return 0, 0, fmt.Errorf("record %v: %w", rec.LSN, err)
+			}
+			lsn = rec.LSN
+		}
+		size += int64(len(line))
+	}
+}
+
+// apply applies a record read from the log
+func (c *Cache) apply(rec *logRecord) error {
+	switch {
+	case rec.Op == opAddUser && rec.User != nil:
+		seq, err := globalid.Decode(globalid.User, rec.User.ID)
+		if err != nil {
+			return err
+		}
+		c.applyAddUser(rec.User, seq)
+	case rec.Op == opAddPost && rec.Post != nil:
+		seq, err := globalid.Decode(globalid.Post, rec.Post.ID)
+		if err != nil {
+			return err
+		}
+		c.applyAddPost(rec.Post, seq)
+	case rec.Op == opAddComment && rec.Comment != nil:
+		seq, err := globalid.Decode(globalid.Comment, rec.Comment.ID)
+		if err != nil {
+			return err
+		}
+		c.applyAddComment(rec.Comment, seq)
+	case rec.Op == opUpdatePost && rec.Post != nil:
+		c.applyUpdatePost(rec.Post)
+	case rec.Op == opUpdateComment && rec.Comment != nil:
+		c.applyUpdateComment(rec.Comment)
+	case rec.Op == opDeletePost || rec.Op == opEvictPost:
+		if post, ok := c.PostsCache[rec.ID]; ok {
+			c.applyDeletePost(post)
+		}
+	case rec.Op == opVoteComment && rec.Vote != nil:
+		if cc, ok := c.cached(rec.Vote.CommentID); ok {
+			c.applyVote(cc, rec.Vote.UserID, rec.Vote.Value)
+		}
+	case rec.Op == opDeleteComment && rec.At != nil:
+		if comment, ok := c.comment(rec.ID); ok {
+			c.applyDeleteComment(comment, *rec.At)
+		}
+	default:
+		return fmt.Errorf("invalid record: %q", rec.Op)
+	}
+	return nil
+}
+
+// writeFileAtomic writes v as json to a temporary file and renames it to path
+func writeFileAtomic(path string, v any) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(tmp.Name())
+
+	err = json.NewEncoder(tmp).Encode(v)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the directory, so created and renamed files survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func(d *os.File) {
+		_ = d.Close()
+	}(d)
+	return d.Sync()
+}
@@ -0,0 +1,241 @@
+package storage_test
+
+import (
+	"context"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage/storagetest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPersistentCache(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return openCache(t, t.TempDir())
+	})
+}
+
+func TestPersistentCacheRestart(t *testing.T) {
+	tests := []struct {
+		name  string
+		close bool
+	}{
+		// Closed cache is restored from the snapshot, otherwise from the log
+		{"Snapshot", true},
+		{"Log", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			c := openCache(t, dir)
+			fill(t, c)
+			want := dump(t, c)
+			if tt.close {
+				if err := c.Close(); err != nil {
+					t.Fatalf("Close: %v", err)
+				}
+			}
+
+			restored := openCache(t, dir)
+			if got := dump(t, restored); !reflect.DeepEqual(got, want) {
+				t.Errorf("restored cache differs from the written one")
+			}
+
+			// New ids continue after the restored ones
+			user, err := restored.AddUser(context.Background(), "carol", "carol@example.com")
+			if err != nil {
+				t.Fatalf("AddUser: %v", err)
+			}
+			for _, u := range want.users {
+				if u.ID == user.ID {
+					t.Errorf("id: %v of a new user is already used", user.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestPersistentCacheIncompleteRecord(t *testing.T) {
+	dir := t.TempDir()
+	c := openCache(t, dir)
+	fill(t, c)
+	want := dump(t, c)
+
+	// A crash during the write leaves a part of the record
+	path := filepath.Join(dir, "log.jsonl")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("unable to open log: %v", err)
+	}
+	if _, err = f.WriteString(`{"lsn":1000,"op":"addUs`); err != nil {
+		t.Fatalf("unable to write log: %v", err)
+	}
+	_ = f.Close()
+
+	restored := openCache(t, dir)
+	if got := dump(t, restored); !reflect.DeepEqual(got, want) {
+		t.Errorf("restored cache differs from the written one")
+	}
+	if _, err = restored.AddUser(context.Background(), "carol", "carol@example.com"); err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	if err = restored.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := openCache(t, dir); len(dump(t, got).users) != len(want.users)+1 {
+		t.Errorf("user added after the incomplete record is lost")
+	}
+}
+
+// openCache opens persistent cache in dir, it is closed after the test
+func openCache(t *testing.T, dir string) *storage.Cache {
+	t.Helper()
+	c, err := storage.NewPersistentCache(storage.PersistenceConfig{Dir: dir, Fsync: storage.FsyncAlways})
+	if err != nil {
+		t.Fatalf("NewPersistentCache: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+	return c
+}
+
+// fill makes every kind of mutation of the cache
+func fill(t *testing.T, c *storage.Cache) {
+	t.Helper()
+	ctx := context.Background()
+
+	alice, err := c.AddUser(ctx, "alice", "alice@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	bob, err := c.AddUser(ctx, "bob", "bob@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	post, err := c.AddPost(ctx, alice.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	removed, err := c.AddPost(ctx, bob.ID, "title", "text", true)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+
+	top, err := c.AddComment(ctx, bob.ID, post.ID, post.ID, "top")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+	reply, err := c.AddComment(ctx, alice.ID, post.ID, top.ID, "reply")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+	last, err := c.AddComment(ctx, alice.ID, post.ID, post.ID, "last")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+
+	title := "new title"
+	if _, err = c.UpdatePost(ctx, alice.ID, post.ID, &title, nil); err != nil {
+		t.Fatalf("UpdatePost: %v", err)
+	}
+	if _, err = c.UpdateComment(ctx, alice.ID, reply.ID, "new reply"); err != nil {
+		t.Fatalf("UpdateComment: %v", err)
+	}
+	// Votes of bob are changed and taken back, votes for the removed comment go with it
+	for _, vote := range []struct {
+		user      *model.User
+		commentId string
+		value     model.VoteValue
+	}{
+		{bob, reply.ID, model.VoteValueDown},
+		{alice, reply.ID, model.VoteValueUp},
+		{bob, reply.ID, model.VoteValueUp},
+		{bob, top.ID, model.VoteValueUp},
+		{bob, top.ID, model.VoteValueNone},
+		{bob, last.ID, model.VoteValueDown},
+	} {
+		if _, err = c.VoteComment(ctx, vote.user.ID, vote.commentId, vote.value); err != nil {
+			t.Fatalf("VoteComment: %v", err)
+		}
+	}
+	// Top comment becomes a tombstone, the last one is removed
+	if err = c.DeleteComment(ctx, bob.ID, top.ID); err != nil {
+		t.Fatalf("DeleteComment: %v", err)
+	}
+	if err = c.DeleteComment(ctx, alice.ID, last.ID); err != nil {
+		t.Fatalf("DeleteComment: %v", err)
+	}
+	reason := "closed"
+	if _, err = c.SetCommentsAllowed(ctx, alice.ID, post.ID, false, &reason); err != nil {
+		t.Fatalf("SetCommentsAllowed: %v", err)
+	}
+	if err = c.DeletePost(ctx, bob.ID, removed.ID); err != nil {
+		t.Fatalf("DeletePost: %v", err)
+	}
+}
+
+// state is what the cache returns for all users and posts, posts of users are kept as ids,
+// votes of users are kept for comments of the posts
+type state struct {
+	users     []model.User
+	userPosts [][]string
+	posts     []*model.Post
+	votes     []map[string]model.VoteValue
+}
+
+func dump(t *testing.T, c *storage.Cache) state {
+	t.Helper()
+	ctx := context.Background()
+
+	users, err := c.GetUsers(ctx)
+	if err != nil {
+		t.Fatalf("GetUsers: %v", err)
+	}
+	all, err := c.GetAllPosts(ctx)
+	if err != nil {
+		t.Fatalf("GetAllPosts: %v", err)
+	}
+	var s state
+	for _, user := range users {
+		var ids []string
+		for _, post := range user.Posts {
+			ids = append(ids, post.ID)
+		}
+		u := *user
+		u.Posts = nil
+		s.users = append(s.users, u)
+		s.userPosts = append(s.userPosts, ids)
+	}
+	for _, post := range all {
+		tree, err := c.GetPost(ctx, post.ID, storage.WholeTree)
+		if err != nil {
+			t.Fatalf("GetPost: %v", err)
+		}
+		s.posts = append(s.posts, tree)
+	}
+	var commentIds []string
+	for _, post := range s.posts {
+		commentIds = append(commentIds, treeIds(post.Comments)...)
+	}
+	for _, user := range users {
+		votes, err := c.GetVotes(ctx, user.ID, commentIds)
+		if err != nil {
+			t.Fatalf("GetVotes: %v", err)
+		}
+		s.votes = append(s.votes, votes)
+	}
+	return s
+}
+
+// treeIds returns ids of all comments in the tree
+func treeIds(comments []*model.Comment) []string {
+	var ids []string
+	for _, comment := range comments {
+		ids = append(ids, comment.ID)
+		ids = append(ids, treeIds(comment.Children)...)
+	}
+	return ids
+}
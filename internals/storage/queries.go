@@ -0,0 +1,1329 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/globalid"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"log"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// row is a row of a query result of pgx or database/sql
+type row interface {
+	Scan(dest ...any) error
+}
+
+// rows are rows of a query result of pgx or database/sql
+type rows interface {
+	row
+	Next() bool
+	Err() error
+	Close()
+}
+
+// querier is the primary, a replica or a transaction. Queries number their parameters as $1, $2 and so on.
+// Query of a single row returns error that wraps sql.ErrNoRows if there is no row.
+type querier interface {
+	Query(ctx context.Context, query string, args ...any) (rows, error)
+	QueryRow(ctx context.Context, query string, args ...any) row
+	Exec(ctx context.Context, query string, args ...any) error
+}
+
+// conn is the primary database
+type conn interface {
+	querier
+	Begin(ctx context.Context) (tx, error)
+}
+
+// tx is a transaction, rollback of a committed transaction does nothing
+type tx interface {
+	querier
+	Commit(ctx context.Context) error
+	Rollback() error
+}
+
+// Kinds of constraint violations
+type violation int
+
+const (
+	uniqueViolation violation = iota
+	foreignKeyViolation
+)
+
+// dialect is what differs in SQL of PostgresStorage and SQLiteStorage
+type dialect struct {
+	// in returns condition that column is one of keys passed as parameter n, keys returns the parameter
+	in   func(column string, n int) string
+	keys func(keys []int64) any
+	// rootPath and childPath are paths of comments in a comment tree, ordering by path puts every comment
+	// after its parent and siblings in the order they were added
+	rootPath, childPath string
+	// forUpdate and forShare lock selected rows until the end of the transaction,
+	// forShare lets other transactions read the rows with forShare too
+	forUpdate, forShare string
+	// constraint returns "table.column" of the constraint violated by err if err is a violation of the kind,
+	// otherwise it returns empty string
+	constraint func(err error, kind violation) string
+}
+
+// sqlStorage is Storage over SQL database, PostgresStorage and SQLiteStorage differ in connections and dialect
+type sqlStorage struct {
+	db       conn
+	dialect  *dialect
+	replicas *replicaSet
+	hub      *CommentHub
+	// maxDepth is the maximum depth of comments, zero means no limit
+	maxDepth atomic.Int32
+}
+
+// SetMaxCommentDepth sets the maximum depth of comments, 0 means no limit. Comments that are already deeper stay.
+func (s *sqlStorage) SetMaxCommentDepth(depth int32) {
+	s.maxDepth.Store(depth)
+}
+
+// write runs f in a transaction on the primary, and commits the transaction if f succeeds
+func (s *sqlStorage) write(ctx context.Context, op string, f func(tx querier) error) error {
+	MarkWritten(ctx)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return internalError("unable to begin transaction at %s: %w", op, err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil {
+			log.Printf("Rollback at %s error: %v", op, err)
+		}
+	}()
+
+	if err = f(tx); err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return internalError("unable to commit transaction at %s: %w", op, err)
+	}
+	return nil
+}
+
+// GetPost returns post via id with its comment tree preloaded up to maxDepth levels,
+// or return error if there is no such post. It is read from a replica.
+func (s *sqlStorage) GetPost(ctx context.Context, postId string, maxDepth int32) (*model.Post, error) {
+	postKey, err := globalid.Decode(globalid.Post, postId)
+	if err != nil {
+		return nil, NewError(ErrNotFound, "Post: %v doesn't exist", postId)
+	}
+
+	var post *model.Post
+	err = s.read(ctx, func(db querier) error {
+		post, err = s.getPost(ctx, db, postId, postKey, maxDepth)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return post, nil
+}
+
+// getPost reads the post with its comment tree from db
+func (s *sqlStorage) getPost(ctx context.Context, db querier, postId string, postKey int64, maxDepth int32) (*model.Post, error) {
+	const op = "storage.queries.GetPost"
+
+	// Getting post data from database
+	post, _, err := scanPost(db.QueryRow(ctx, `SELECT `+postColumns+` FROM posts
+                        WHERE id = $1 `, postKey))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, NewError(ErrNotFound, "Post: %v doesn't exist", postId)
+	}
+	if err != nil {
+		return nil, internalError("unable to get post at %s: %w", op, err)
+	}
+	if maxDepth == 0 {
+		return post, nil
+	}
+
+	if post.Comments, err = s.commentTree(ctx, db, op, `post_id = $1 AND parent_id IS NULL`, postKey, postKey,
+		maxDepth, allReplies); err != nil {
+		return nil, err
+	}
+	post.CommentsLoaded = true
+
+	return post, nil
+}
+
+// commentTree reads comments of the post up to maxDepth levels, the first level is selected by filter with filterKey as $1.
+// Replies of comments with more than maxBreadth replies are not read.
+func (s *sqlStorage) commentTree(ctx context.Context, db querier, op, filter string, filterKey, postKey int64,
+	maxDepth, maxBreadth int32) ([]*model.Comment, error) {
+	rows, err := db.Query(ctx, `WITH RECURSIVE tree AS (
+							SELECT id, user_id, parent_id, body, created_at, updated_at, deleted, depth,
+							       upvotes, downvotes, 1 AS level,
+							       (SELECT count(*) FROM comments AS r WHERE r.parent_id = comments.id) AS children,
+							       `+s.dialect.rootPath+` AS path
+							FROM comments WHERE `+filter+`
+							UNION ALL
+							SELECT c.id, c.user_id, c.parent_id, c.body, c.created_at, c.updated_at, c.deleted,
+							       c.depth, c.upvotes, c.downvotes, t.level + 1,
+							       (SELECT count(*) FROM comments AS r WHERE r.parent_id = c.id), `+s.dialect.childPath+`
+							FROM comments AS c JOIN tree AS t ON c.parent_id = t.id
+							WHERE ($2 < 0 OR t.level < $2) AND ($3 < 0 OR t.children <= $3)
+						)
+						SELECT id, user_id, parent_id, body, created_at, updated_at, deleted, depth, upvotes, downvotes,
+						       level, children
+						FROM tree ORDER BY path`, filterKey, maxDepth, maxBreadth)
+	if err != nil {
+		return nil, internalError("unable to get comments at %s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var top []*model.Comment
+	comments := make(map[string]*model.Comment)
+	for rows.Next() {
+
+		comment := &model.Comment{}
+		var key, userKey int64
+		var parentKey *int64
+		var level int32
+
+		if err = rows.Scan(&key, &userKey, &parentKey, &comment.Text, &comment.CreatedAt, &comment.UpdatedAt,
+			&comment.Deleted, &comment.Depth, &comment.Upvotes, &comment.Downvotes, &level,
+			&comment.ChildrenCount); err != nil {
+			return nil, internalError("unable to scan row at %s: %w", op, err)
+		}
+		setCommentIds(comment, key, userKey, postKey, parentKey)
+		comment.ChildrenLoaded = (maxDepth == WholeTree || level < maxDepth) &&
+			fitsBreadth(comment.ChildrenCount, maxBreadth)
+		comments[comment.ID] = comment
+
+		// Parent is always scanned before its children
+		if level == 1 {
+			top = append(top, comment)
+		} else {
+			parent := comments[comment.ParentID]
+			parent.Children = append(parent.Children, comment)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, internalError("unable to read comments at %s: %w", op, err)
+	}
+	return top, nil
+}
+
+// GetComment returns comment via id with its replies preloaded up to maxDepth levels below it,
+// or returns error if there is no such comment. It is read from a replica.
+func (s *sqlStorage) GetComment(ctx context.Context, commentId string, maxDepth int32) (*model.Comment, error) {
+	key, err := globalid.Decode(globalid.Comment, commentId)
+	if err != nil {
+		return nil, NewError(ErrNotFound, "Comment: %v doesn't exist", commentId)
+	}
+
+	var comment *model.Comment
+	err = s.read(ctx, func(db querier) error {
+		comment, err = s.getComment(ctx, db, commentId, key, maxDepth)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return comment, nil
+}
+
+// getComment reads the comment with its replies from db
+func (s *sqlStorage) getComment(ctx context.Context, db querier, commentId string, key int64,
+	maxDepth int32) (*model.Comment, error) {
+	const op = "storage.queries.GetComment"
+
+	comment, err := scanComment(db.QueryRow(ctx, `SELECT `+commentColumns+` FROM comments WHERE id = $1`, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, NewError(ErrNotFound, "Comment: %v doesn't exist", commentId)
+	}
+	if err != nil {
+		return nil, internalError("unable to get comment at %s: %w", op, err)
+	}
+	if maxDepth == 0 || !fitsBreadth(comment.ChildrenCount, commentWindowBreadth) {
+		return comment, nil
+	}
+
+	postKey, err := globalid.Decode(globalid.Post, comment.PostID)
+	if err != nil {
+		return nil, internalError("unable to decode post of comment at %s: %w", op, err)
+	}
+	if comment.Children, err = s.commentTree(ctx, db, op, `parent_id = $1`, key, postKey, maxDepth,
+		commentWindowBreadth); err != nil {
+		return nil, err
+	}
+	comment.ChildrenLoaded = true
+	return comment, nil
+}
+
+// GetComments returns comments via ids without their replies, unknown comments are skipped.
+// They are read from a replica.
+func (s *sqlStorage) GetComments(ctx context.Context, commentIds []string) (map[string]*model.Comment, error) {
+	keys := globalid.DecodeAll(globalid.Comment, commentIds)
+
+	var comments map[string]*model.Comment
+	err := s.read(ctx, func(db querier) error {
+		var err error
+		comments, err = s.getComments(ctx, db, keys)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return comments, nil
+}
+
+// getComments reads comments via keys from db
+func (s *sqlStorage) getComments(ctx context.Context, db querier, keys []int64) (map[string]*model.Comment, error) {
+	const op = "storage.queries.GetComments"
+
+	rows, err := db.Query(ctx, `SELECT `+commentColumns+` FROM comments WHERE `+s.dialect.in("id", 1),
+		s.dialect.keys(keys))
+	if err != nil {
+		return nil, internalError("unable to get comments at %s: %w", op, err)
+	}
+	defer rows.Close()
+
+	comments := make(map[string]*model.Comment, len(keys))
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, internalError("unable to scan comment at %s: %w", op, err)
+		}
+		comments[comment.ID] = comment
+	}
+	if err = rows.Err(); err != nil {
+		return nil, internalError("unable to read comments at %s: %w", op, err)
+	}
+	return comments, nil
+}
+
+// GetAncestorsByComments returns parents of each comment from its top level comment down to its parent,
+// top level comments have none. Unknown comments are skipped. They are read from a replica.
+func (s *sqlStorage) GetAncestorsByComments(ctx context.Context, commentIds []string) (map[string][]*model.Comment, error) {
+	keys := globalid.DecodeAll(globalid.Comment, commentIds)
+
+	var ancestors map[string][]*model.Comment
+	err := s.read(ctx, func(db querier) error {
+		var err error
+		ancestors, err = s.getAncestors(ctx, db, keys)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ancestors, nil
+}
+
+// getAncestors reads parents of comments via keys from db
+func (s *sqlStorage) getAncestors(ctx context.Context, db querier, keys []int64) (map[string][]*model.Comment, error) {
+	const op = "storage.queries.GetAncestorsByComments"
+
+	// Chains go up from the comments to their top level comments, common parents are read once
+	rows, err := db.Query(ctx, `WITH RECURSIVE chain AS (
+							SELECT id, parent_id FROM comments WHERE `+s.dialect.in("id", 1)+`
+							UNION
+							SELECT c.id, c.parent_id FROM comments AS c JOIN chain AS t ON c.id = t.parent_id
+						)
+						SELECT `+commentColumns+` FROM comments WHERE id IN (SELECT id FROM chain)`,
+		s.dialect.keys(keys))
+	if err != nil {
+		return nil, internalError("unable to get ancestors at %s: %w", op, err)
+	}
+	defer rows.Close()
+
+	comments := make(map[string]*model.Comment)
+	for rows.Next() {
+		comment, err := scanComment(rows)
+		if err != nil {
+			return nil, internalError("unable to scan comment at %s: %w", op, err)
+		}
+		comments[comment.ID] = comment
+	}
+	if err = rows.Err(); err != nil {
+		return nil, internalError("unable to read ancestors at %s: %w", op, err)
+	}
+
+	ancestors := make(map[string][]*model.Comment, len(keys))
+	for _, key := range keys {
+		comment, ok := comments[globalid.Encode(globalid.Comment, key)]
+		if !ok {
+			continue
+		}
+		chain := make([]*model.Comment, 0, max(comment.Depth-1, 0))
+		for comment.ParentID != comment.PostID {
+			if comment, ok = comments[comment.ParentID]; !ok {
+				break
+			}
+			chain = append(chain, comment)
+		}
+		slices.Reverse(chain)
+		ancestors[globalid.Encode(globalid.Comment, key)] = chain
+	}
+	return ancestors, nil
+}
+
+// GetAllPosts returns all posts from database. Comments are not loaded, they are resolved separately.
+// They are read from a replica.
+func (s *sqlStorage) GetAllPosts(ctx context.Context) ([]*model.Post, error) {
+	var posts []*model.Post
+	err := s.read(ctx, func(db querier) error {
+		var err error
+		posts, err = getAllPosts(ctx, db)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// getAllPosts reads all posts from db
+func getAllPosts(ctx context.Context, db querier) ([]*model.Post, error) {
+	const op = "storage.queries.GetAllPost"
+
+	rows, err := db.Query(ctx, `SELECT `+postColumns+` FROM posts ORDER BY id`)
+	if err != nil {
+		return nil, internalError("unable to get all posts at %s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var posts []*model.Post
+
+	for rows.Next() {
+
+		post, _, err := scanPost(rows)
+		if err != nil {
+			return nil, internalError("unable to scan posts at %s: %w", op, err)
+		}
+		posts = append(posts, post)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, internalError("unable to read posts at %s: %w", op, err)
+	}
+	return posts, nil
+}
+
+// GetPosts returns a page of posts from database, newest first. It is read from a replica.
+func (s *sqlStorage) GetPosts(ctx context.Context, page Page) (*model.PostConnection, error) {
+	var conn *model.PostConnection
+	err := s.read(ctx, func(db querier) error {
+		var err error
+		conn, err = getPosts(ctx, db, page)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// getPosts reads a page of posts from db
+func getPosts(ctx context.Context, db querier, page Page) (*model.PostConnection, error) {
+	const op = "storage.queries.GetPosts"
+
+	b, err := page.bounds()
+	if err != nil {
+		return nil, err
+	}
+
+	// Newest first means descending id, so the posts between cursors have before < id < after
+	var conditions []string
+	var args []any
+	if b.hasAfter {
+		args = append(args, b.after)
+		conditions = append(conditions, fmt.Sprintf("id < $%d", len(args)))
+	}
+	if b.hasBefore {
+		args = append(args, b.before)
+		conditions = append(conditions, fmt.Sprintf("id > $%d", len(args)))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	order := "DESC"
+	if b.backward {
+		order = "ASC"
+	}
+
+	// One extra row tells if there are more posts in the direction of paging
+	args = append(args, b.limit+1)
+	rows, err := db.Query(ctx, fmt.Sprintf(`SELECT %s
+						FROM posts %s ORDER BY id %s LIMIT $%d`, postColumns, where, order, len(args)), args...)
+	if err != nil {
+		return nil, internalError("unable to get posts at %s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var keys []int64
+	var posts []*model.Post
+	for rows.Next() {
+		post, key, err := scanPost(rows)
+		if err != nil {
+			return nil, internalError("unable to scan posts at %s: %w", op, err)
+		}
+		keys = append(keys, key)
+		posts = append(posts, post)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, internalError("unable to read posts at %s: %w", op, err)
+	}
+
+	hasMore := len(posts) > b.limit
+	if hasMore {
+		keys, posts = keys[:b.limit], posts[:b.limit]
+	}
+	if b.backward {
+		slices.Reverse(keys)
+		slices.Reverse(posts)
+	}
+
+	edges := make([]*model.PostEdge, 0, len(posts))
+	for i, post := range posts {
+		edges = append(edges, &model.PostEdge{Cursor: encodeCursor(keys[i]), Node: post})
+	}
+
+	// Check if there are posts on the other side of the page, an empty page is bounded by its cursor
+	var query string
+	var key int64
+	switch {
+	case len(keys) > 0 && !b.backward:
+		query, key = `SELECT EXISTS(SELECT 1 FROM posts WHERE id > $1)`, keys[0]
+	case len(keys) > 0:
+		query, key = `SELECT EXISTS(SELECT 1 FROM posts WHERE id < $1)`, keys[len(keys)-1]
+	case !b.backward && b.hasAfter:
+		query, key = `SELECT EXISTS(SELECT 1 FROM posts WHERE id >= $1)`, b.after
+	case b.backward && b.hasBefore:
+		query, key = `SELECT EXISTS(SELECT 1 FROM posts WHERE id <= $1)`, b.before
+	}
+	var hasOther bool
+	if query != "" {
+		if err = db.QueryRow(ctx, query, key).Scan(&hasOther); err != nil {
+			return nil, internalError("unable to check page bounds at %s: %w", op, err)
+		}
+	}
+
+	var total int32
+	if err = db.QueryRow(ctx, `SELECT count(*) FROM posts`).Scan(&total); err != nil {
+		return nil, internalError("unable to count posts at %s: %w", op, err)
+	}
+
+	hasNext, hasPrevious := hasMore, hasOther
+	if b.backward {
+		hasNext, hasPrevious = hasOther, hasMore
+	}
+	return &model.PostConnection{
+		Edges:      edges,
+		PageInfo:   newPageInfo(len(edges), func(i int) string { return edges[i].Cursor }, hasNext, hasPrevious),
+		TotalCount: total,
+	}, nil
+}
+
+// GetCommentsByPosts returns a page of top level comments in the order of the page for each post.
+// Unknown posts get an empty page. They are read from a replica.
+func (s *sqlStorage) GetCommentsByPosts(ctx context.Context, postIds []string, page Page) (map[string]*model.CommentConnection, error) {
+	const op = "storage.queries.GetCommentsByPosts"
+	return s.commentsPages(ctx, op, "post_id", s.dialect.in("post_id", 1)+` AND parent_id IS NULL`,
+		globalid.Post, postIds, page)
+}
+
+// GetChildrenByComments returns a page of replies in the order of the page for each comment.
+// Unknown comments get an empty page. They are read from a replica.
+func (s *sqlStorage) GetChildrenByComments(ctx context.Context, commentIds []string, page Page) (map[string]*model.CommentConnection, error) {
+	const op = "storage.queries.GetChildrenByComments"
+	return s.commentsPages(ctx, op, "parent_id", s.dialect.in("parent_id", 1), globalid.Comment, commentIds, page)
+}
+
+// commentsPages returns a page of comments matching filter in the order of the page for each of ids of the type.
+// Filter takes keys of ids as $1, comments are grouped by the column.
+func (s *sqlStorage) commentsPages(ctx context.Context, op, column, filter string, t globalid.Type, ids []string,
+	page Page) (map[string]*model.CommentConnection, error) {
+	b, err := page.commentBounds()
+	if err != nil {
+		return nil, err
+	}
+
+	var pages map[string]*model.CommentConnection
+	err = s.read(ctx, func(db querier) error {
+		pages, err = s.readCommentsPages(ctx, db, op, column, filter, t, ids, b)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pages, nil
+}
+
+// readCommentsPages reads pages of comments from db
+func (s *sqlStorage) readCommentsPages(ctx context.Context, db querier, op, column, filter string, t globalid.Type,
+	ids []string, b commentBounds) (map[string]*model.CommentConnection, error) {
+	// Keys of the cursor follow keys of ids in parameters
+	after, before := "TRUE", "FALSE"
+	args := []any{s.dialect.keys(globalid.DecodeAll(t, ids))}
+	if b.after != nil {
+		after = b.order.sqlAfter("$%d", 2)
+		before = "NOT " + after
+		for _, key := range b.after {
+			args = append(args, key)
+		}
+	}
+
+	// Count all comments and comments before the cursor in each group
+	rows, err := db.Query(ctx, `SELECT `+column+`, count(*), count(*) FILTER (WHERE `+before+`)
+						FROM comments WHERE `+filter+` GROUP BY `+column, args...)
+	if err != nil {
+		return nil, internalError("unable to count comments at %s: %w", op, err)
+	}
+	defer rows.Close()
+
+	pages := make(map[string]*model.CommentConnection, len(ids))
+	skipped := make(map[string]int32, len(ids))
+	for _, id := range ids {
+		pages[id] = &model.CommentConnection{Edges: []*model.CommentEdge{}}
+	}
+	for rows.Next() {
+		var id int64
+		var total, before int32
+		if err = rows.Scan(&id, &total, &before); err != nil {
+			return nil, internalError("unable to scan comments count at %s: %w", op, err)
+		}
+		key := globalid.Encode(t, id)
+		pages[key].TotalCount = total
+		skipped[key] = before
+	}
+	if err = rows.Err(); err != nil {
+		return nil, internalError("unable to read comments count at %s: %w", op, err)
+	}
+
+	// Take limit+1 comments after the cursor of each group, the extra one tells if there is a next page
+	rows, err = db.Query(ctx, `SELECT id, user_id, post_id, parent, body, created_at, updated_at, deleted,
+       					depth, upvotes, downvotes, children, group_id FROM (
+							SELECT id, user_id, post_id, parent_id AS parent, body, created_at,
+							       updated_at, deleted, depth, upvotes, downvotes,
+							       (SELECT count(*) FROM comments AS c WHERE c.parent_id = comments.id) AS children,
+							       `+column+` AS group_id,
+								   row_number() OVER (PARTITION BY `+column+` ORDER BY `+b.order.sqlOrderBy()+`) AS n
+							FROM comments WHERE `+filter+` AND `+after+`
+						) AS page WHERE n <= `+fmt.Sprintf("$%d", len(args)+1)+` ORDER BY group_id, n`,
+		append(args, b.limit+1)...)
+	if err != nil {
+		return nil, internalError("unable to get comments at %s: %w", op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		comment := &model.Comment{}
+		var key, userKey, postKey, groupId int64
+		var parentKey *int64
+		if err = rows.Scan(&key, &userKey, &postKey, &parentKey, &comment.Text, &comment.CreatedAt, &comment.UpdatedAt,
+			&comment.Deleted, &comment.Depth, &comment.Upvotes, &comment.Downvotes, &comment.ChildrenCount,
+			&groupId); err != nil {
+			return nil, internalError("unable to scan comment at %s: %w", op, err)
+		}
+		setCommentIds(comment, key, userKey, postKey, parentKey)
+
+		conn := pages[globalid.Encode(t, groupId)]
+		cursor := encodeCommentCursor(b.sort, b.order.keys(comment, key))
+		conn.Edges = append(conn.Edges, &model.CommentEdge{Cursor: cursor, Node: comment})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, internalError("unable to read comments at %s: %w", op, err)
+	}
+
+	for id, conn := range pages {
+		hasNext := len(conn.Edges) > b.limit
+		if hasNext {
+			conn.Edges = conn.Edges[:b.limit]
+		}
+		edges := conn.Edges
+		conn.PageInfo = newPageInfo(len(edges), func(i int) string { return edges[i].Cursor }, hasNext, skipped[id] > 0)
+	}
+	return pages, nil
+}
+
+// GetPostsByUsers returns posts of each user in the order they were added. They are read from a replica.
+func (s *sqlStorage) GetPostsByUsers(ctx context.Context, userIds []string) (map[string][]*model.Post, error) {
+	keys := globalid.DecodeAll(globalid.User, userIds)
+
+	var posts map[string][]*model.Post
+	err := s.read(ctx, func(db querier) error {
+		var err error
+		posts, err = s.getPostsByUsers(ctx, db, keys)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// getPostsByUsers reads posts of users via keys from db
+func (s *sqlStorage) getPostsByUsers(ctx context.Context, db querier, keys []int64) (map[string][]*model.Post, error) {
+	const op = "storage.queries.GetPostsByUsers"
+
+	rows, err := db.Query(ctx, `SELECT `+postColumns+`
+						FROM posts WHERE `+s.dialect.in("user_id", 1)+` ORDER BY id`, s.dialect.keys(keys))
+	if err != nil {
+		return nil, internalError("unable to get posts at %s: %w", op, err)
+	}
+	defer rows.Close()
+
+	posts := make(map[string][]*model.Post, len(keys))
+	for rows.Next() {
+		post, _, err := scanPost(rows)
+		if err != nil {
+			return nil, internalError("unable to scan posts at %s: %w", op, err)
+		}
+		posts[post.UserID] = append(posts[post.UserID], post)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, internalError("unable to read posts at %s: %w", op, err)
+	}
+	return posts, nil
+}
+
+// GetUser returns user via id, or returns error if there is no such user. It is read from a replica.
+func (s *sqlStorage) GetUser(ctx context.Context, userId string) (*model.User, error) {
+	key, err := globalid.Decode(globalid.User, userId)
+	if err != nil {
+		return nil, NewError(ErrNotFound, "User: %v doesn't exist", userId)
+	}
+
+	var user *model.User
+	err = s.read(ctx, func(db querier) error {
+		user, err = getUser(ctx, db, userId, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// getUser reads the user from db
+func getUser(ctx context.Context, db querier, userId string, key int64) (*model.User, error) {
+	const op = "storage.queries.GetUser"
+
+	user, err := scanUser(db.QueryRow(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, NewError(ErrNotFound, "User: %v doesn't exist", userId)
+	}
+	if err != nil {
+		return nil, internalError("unable to get user at %s: %w", op, err)
+	}
+	return user, nil
+}
+
+// GetUserByUsername returns user via username, or returns error if there is no such user.
+// It is read from a replica.
+func (s *sqlStorage) GetUserByUsername(ctx context.Context, username string) (*model.User, error) {
+	var user *model.User
+	err := s.read(ctx, func(db querier) error {
+		var err error
+		user, err = getUserByUsername(ctx, db, username)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// getUserByUsername reads the user via username from db
+func getUserByUsername(ctx context.Context, db querier, username string) (*model.User, error) {
+	const op = "storage.queries.GetUserByUsername"
+
+	user, err := scanUser(db.QueryRow(ctx, `SELECT `+userColumns+` FROM users
+                        WHERE username = $1`, username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, NewError(ErrNotFound, "User with username: %v doesn't exist", username)
+	}
+	if err != nil {
+		return nil, internalError("unable to get user at %s: %w", op, err)
+	}
+	return user, nil
+}
+
+// GetUsers returns all users in the order they were added. They are read from a replica.
+func (s *sqlStorage) GetUsers(ctx context.Context) ([]*model.User, error) {
+	var users []*model.User
+	err := s.read(ctx, func(db querier) error {
+		var err error
+		users, err = getUsers(ctx, db)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// getUsers reads all users from db
+func getUsers(ctx context.Context, db querier) ([]*model.User, error) {
+	const op = "storage.queries.GetUsers"
+
+	rows, err := db.Query(ctx, `SELECT `+userColumns+` FROM users ORDER BY id`)
+	if err != nil {
+		return nil, internalError("unable to get users at %s: %w", op, err)
+	}
+	defer rows.Close()
+
+	users := []*model.User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, internalError("unable to scan users at %s: %w", op, err)
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, internalError("unable to read users at %s: %w", op, err)
+	}
+	return users, nil
+}
+
+func (s *sqlStorage) AddUser(ctx context.Context, name, email string) (*model.User, error) {
+	const op = "storage.queries.AddUser"
+
+	var user *model.User
+	err := s.write(ctx, op, func(tx querier) error {
+		var err error
+		now := time.Now().UTC()
+		user, err = scanUser(tx.QueryRow(ctx, `INSERT INTO users (username, email, created_at, updated_at)
+												VALUES ($1, $2, $3, $3) RETURNING `+userColumns, name, email, now))
+		switch s.dialect.constraint(err, uniqueViolation) {
+		case "users.username":
+			return NewError(ErrConflict, "User with username: %v is already exists", name)
+		case "users.email":
+			return NewError(ErrConflict, "User with email: %v is already exists", email)
+		}
+		if err != nil {
+			return internalError("unable to add user at %s: %w", op, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (s *sqlStorage) AddPost(ctx context.Context, userId string, title string, text string, allowComments bool) (*model.Post, error) {
+	const op = "storage.queries.AddPost"
+
+	if title == "" {
+		return nil, NewError(ErrValidation, "Title of post is empty")
+	}
+	if text == "" {
+		return nil, NewError(ErrValidation, "Text of post is empty")
+	}
+	userKey, err := globalid.Decode(globalid.User, userId)
+	if err != nil {
+		return nil, NewError(ErrNotFound, "User: %v doesn't exist", userId)
+	}
+
+	var post *model.Post
+	err = s.write(ctx, op, func(tx querier) error {
+		// Post without comments is closed for comments from the start
+		now := time.Now().UTC()
+		var closedAt *time.Time
+		if !allowComments {
+			closedAt = &now
+		}
+		post, _, err = scanPost(tx.QueryRow(ctx, `INSERT INTO posts (user_id, title, body, permission,
+                   								comments_closed_at, created_at, updated_at)
+												VALUES ($1, $2, $3, $4, $5, $6, $6)
+												RETURNING `+postColumns, userKey, title, text, allowComments, closedAt, now))
+		if s.dialect.constraint(err, foreignKeyViolation) != "" {
+			return NewError(ErrNotFound, "User: %v doesn't exist", userId)
+		}
+		if err != nil {
+			return internalError("unable to add post at %s: %w", op, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	post.Comments = []*model.Comment{}
+	return post, nil
+}
+
+func (s *sqlStorage) AddComment(ctx context.Context, userId, postId, parentId, text string) (*model.Comment, error) {
+	const op = "storage.queries.AddComment"
+
+	if err := checkCommentText(text); err != nil {
+		return nil, err
+	}
+
+	postKey, err := globalid.Decode(globalid.Post, postId)
+	if err != nil {
+		return nil, NewError(ErrNotFound, "Post: %v doesn't exist", postId)
+	}
+	userKey, err := globalid.Decode(globalid.User, userId)
+	if err != nil {
+		return nil, NewError(ErrNotFound, "User: %v doesn't exist", userId)
+	}
+
+	// Top level comments have no parent comment, so parent_id is null
+	var parentKey *int64
+	if parentId != postId {
+		key, err := globalid.Decode(globalid.Comment, parentId)
+		if err != nil {
+			return nil, NewError(ErrNotFound, "Comment: %v doesn't exist", parentId)
+		}
+		parentKey = &key
+	}
+
+	comment := &model.Comment{Text: text, Children: []*model.Comment{}, Depth: 1}
+	err = s.write(ctx, op, func(tx querier) error {
+		// The post is locked, so it can't be closed for comments until the comment is added
+		var permission bool
+		var reason *string
+		err := tx.QueryRow(ctx, `SELECT permission, comments_closed_reason FROM posts WHERE id = $1`+s.dialect.forShare,
+			postKey).Scan(&permission, &reason)
+		if errors.Is(err, sql.ErrNoRows) {
+			return NewError(ErrNotFound, "Post: %v doesn't exist", postId)
+		}
+		if err != nil {
+			return internalError("unable to check if post: %v has a permission to add comments %s: %w", postId, op, err)
+		}
+		if !permission {
+			return commentsClosedError(postId, reason)
+		}
+
+		// Post and depth of the parent don't change, so they are read without a lock
+		if parentKey != nil {
+			var parentPostKey int64
+			var depth int32
+			err = tx.QueryRow(ctx, `SELECT post_id, depth FROM comments WHERE id = $1`, *parentKey).Scan(&parentPostKey,
+				&depth)
+			if errors.Is(err, sql.ErrNoRows) {
+				return NewError(ErrNotFound, "Comment: %v doesn't exist", parentId)
+			}
+			if err != nil {
+				return internalError("unable to get comment: %v at %s: %w", parentId, op, err)
+			}
+			if parentPostKey != postKey {
+				return NewError(ErrValidation, "Comment: %v doesn't belong to post: %v", parentId, postId)
+			}
+			if err = checkCommentDepth(parentId, depth, s.maxDepth.Load()); err != nil {
+				return err
+			}
+			comment.Depth = depth + 1
+		}
+
+		var key int64
+		createdAt := time.Now().UTC()
+		err = tx.QueryRow(ctx, `INSERT INTO comments (user_id, post_id, parent_id, body, created_at,
+                      								updated_at, depth) VALUES ($1, $2, $3, $4, $5, $5, $6) RETURNING id`,
+			userKey, postKey, parentKey, text, createdAt, comment.Depth).Scan(&key)
+		switch s.dialect.constraint(err, foreignKeyViolation) {
+		case "":
+		case "comments.user_id":
+			return NewError(ErrNotFound, "User: %v doesn't exist", userId)
+		case "comments.post_id":
+			return NewError(ErrNotFound, "Post: %v doesn't exist", postId)
+		case "comments.parent_id":
+			return NewError(ErrNotFound, "Comment: %v doesn't exist", parentId)
+		default:
+			// Sqlite doesn't name the violated foreign key,
+			// but the post and the parent are checked in the transaction, so only the user may be missing
+			return NewError(ErrNotFound, "User: %v doesn't exist", userId)
+		}
+		if err != nil {
+			return internalError("unable to add comment at %s: %w", op, err)
+		}
+		setCommentIds(comment, key, userKey, postKey, parentKey)
+		comment.CreatedAt, comment.UpdatedAt = createdAt, createdAt
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.hub.Publish(comment)
+
+	return comment, nil
+}
+
+// SubscribeComments returns a channel with new comments to the post, or returns error if there is no such post.
+// The channel is closed when ctx is done.
+func (s *sqlStorage) SubscribeComments(ctx context.Context, postId string) (<-chan *model.Comment, error) {
+	const op = "storage.queries.SubscribeComments"
+
+	key, err := globalid.Decode(globalid.Post, postId)
+	if err != nil {
+		return nil, NewError(ErrNotFound, "Post: %v doesn't exist", postId)
+	}
+
+	var exists bool
+	err = s.db.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM posts WHERE id = $1)`, key).Scan(&exists)
+	if err != nil {
+		return nil, internalError("unable to check post: %v at %s: %w", postId, op, err)
+	}
+	if !exists {
+		return nil, NewError(ErrNotFound, "Post: %v doesn't exist", postId)
+	}
+
+	return s.hub.Subscribe(ctx, postId), nil
+}
+
+// UpdatePost changes title and text of the post if they are set, and returns this post.
+// It returns error if there is no such post, user is not its author, or new title or text is empty.
+func (s *sqlStorage) UpdatePost(ctx context.Context, userId, postId string, title, text *string) (*model.Post, error) {
+	const op = "storage.queries.UpdatePost"
+
+	if title != nil && *title == "" {
+		return nil, NewError(ErrValidation, "Title of post: %v is empty", postId)
+	}
+	if text != nil && *text == "" {
+		return nil, NewError(ErrValidation, "Text of post: %v is empty", postId)
+	}
+
+	var post *model.Post
+	err := s.write(ctx, op, func(tx querier) error {
+		key, err := s.checkAuthor(ctx, tx, op, `SELECT user_id FROM posts WHERE id = $1`, globalid.Post, userId, postId)
+		if err != nil {
+			return err
+		}
+
+		post, _, err = scanPost(tx.QueryRow(ctx, `UPDATE posts
+						SET title = COALESCE($2, title), body = COALESCE($3, body), updated_at = $4
+						WHERE id = $1 RETURNING `+postColumns, key, title, text, time.Now().UTC()))
+		if err != nil {
+			return internalError("unable to update post at %s: %w", op, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return post, nil
+}
+
+// DeletePost removes the post with all its comments,
+// or returns error if there is no such post or user is not its author
+func (s *sqlStorage) DeletePost(ctx context.Context, userId, postId string) error {
+	const op = "storage.queries.DeletePost"
+
+	return s.write(ctx, op, func(tx querier) error {
+		key, err := s.checkAuthor(ctx, tx, op, `SELECT user_id FROM posts WHERE id = $1`, globalid.Post, userId, postId)
+		if err != nil {
+			return err
+		}
+
+		// Comments are removed by the foreign key cascade
+		if err = tx.Exec(ctx, `DELETE FROM posts WHERE id = $1`, key); err != nil {
+			return internalError("unable to delete post at %s: %w", op, err)
+		}
+		return nil
+	})
+}
+
+// UpdateComment changes text of the comment and returns this comment. It returns error if there is no such comment,
+// user is not its author, comment is deleted, or new text is empty or more then 2000 symbols.
+func (s *sqlStorage) UpdateComment(ctx context.Context, userId, commentId, text string) (*model.Comment, error) {
+	const op = "storage.queries.UpdateComment"
+
+	if err := checkCommentText(text); err != nil {
+		return nil, err
+	}
+
+	var comment *model.Comment
+	err := s.write(ctx, op, func(tx querier) error {
+		key, err := s.checkAuthor(ctx, tx, op, `SELECT user_id FROM comments WHERE id = $1 AND NOT deleted`,
+			globalid.Comment, userId, commentId)
+		if err != nil {
+			return err
+		}
+
+		comment, err = scanComment(tx.QueryRow(ctx, `UPDATE comments SET body = $2, updated_at = $3 WHERE id = $1
+						RETURNING `+commentColumns, key, text, time.Now().UTC()))
+		if err != nil {
+			return internalError("unable to update comment at %s: %w", op, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return comment, nil
+}
+
+// DeleteComment removes the comment, or returns error if there is no such comment or user is not its author.
+// Comment with replies stays in the tree as a tombstone, tombstones are removed with their last reply.
+func (s *sqlStorage) DeleteComment(ctx context.Context, userId, commentId string) error {
+	const op = "storage.queries.DeleteComment"
+
+	return s.write(ctx, op, func(tx querier) error {
+		key, err := s.checkAuthor(ctx, tx, op, `SELECT user_id FROM comments WHERE id = $1 AND NOT deleted`,
+			globalid.Comment, userId, commentId)
+		if err != nil {
+			return err
+		}
+
+		// Comment with replies becomes a tombstone, otherwise it is removed
+		// and its parent is checked the same way if it is a tombstone
+		id := &key
+		for id != nil {
+			var hasChildren bool
+			err = tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM comments WHERE parent_id = $1)`,
+				*id).Scan(&hasChildren)
+			if err != nil {
+				return internalError("unable to check replies at %s: %w", op, err)
+			}
+			if hasChildren {
+				err = tx.Exec(ctx, `UPDATE comments SET body = $2, deleted = true, updated_at = $3
+						WHERE id = $1`,
+					*id, model.DeletedCommentText, time.Now().UTC())
+				if err != nil {
+					return internalError("unable to mark comment deleted at %s: %w", op, err)
+				}
+				break
+			}
+
+			var parentKey *int64
+			var parentDeleted *bool
+			err = tx.QueryRow(ctx, `SELECT c.parent_id, p.deleted FROM comments AS c
+						LEFT JOIN comments AS p ON p.id = c.parent_id WHERE c.id = $1`,
+				*id).Scan(&parentKey, &parentDeleted)
+			if err != nil {
+				return internalError("unable to get parent of comment at %s: %w", op, err)
+			}
+			if err = tx.Exec(ctx, `DELETE FROM comments WHERE id = $1`, *id); err != nil {
+				return internalError("unable to delete comment at %s: %w", op, err)
+			}
+
+			id = nil
+			if parentDeleted != nil && *parentDeleted {
+				id = parentKey
+			}
+		}
+		return nil
+	})
+}
+
+// VoteComment sets the vote of the user for the comment, NONE takes the vote back, and returns this comment.
+// It returns error if there is no such user or comment, or the comment is deleted.
+func (s *sqlStorage) VoteComment(ctx context.Context, userId, commentId string, value model.VoteValue) (*model.Comment, error) {
+	const op = "storage.queries.VoteComment"
+
+	vote, err := voteOf(value)
+	if err != nil {
+		return nil, err
+	}
+	userKey, err := globalid.Decode(globalid.User, userId)
+	if err != nil {
+		return nil, NewError(ErrNotFound, "User: %v doesn't exist", userId)
+	}
+	key, err := globalid.Decode(globalid.Comment, commentId)
+	if err != nil {
+		return nil, NewError(ErrNotFound, "Comment: %v doesn't exist", commentId)
+	}
+
+	var comment *model.Comment
+	err = s.write(ctx, op, func(tx querier) error {
+		// The comment is locked, so votes for it are counted one by one
+		var userExists bool
+		err := tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE id = $2) FROM comments
+						WHERE id = $1 AND NOT deleted`+s.dialect.forUpdate, key, userKey).Scan(&userExists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return NewError(ErrNotFound, "Comment: %v doesn't exist", commentId)
+		}
+		if err != nil {
+			return internalError("unable to get comment at %s: %w", op, err)
+		}
+		if !userExists {
+			return NewError(ErrNotFound, "User: %v doesn't exist", userId)
+		}
+		var old int8
+		err = tx.QueryRow(ctx, `SELECT value FROM votes WHERE comment_id = $1 AND user_id = $2`, key,
+			userKey).Scan(&old)
+		// User without a vote has no row
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+		if err != nil {
+			return internalError("unable to get vote at %s: %w", op, err)
+		}
+
+		switch {
+		case vote == old:
+		case vote == 0:
+			err = tx.Exec(ctx, `DELETE FROM votes WHERE comment_id = $1 AND user_id = $2`, key, userKey)
+		default:
+			err = tx.Exec(ctx, `INSERT INTO votes (comment_id, user_id, value) VALUES ($1, $2, $3)
+						ON CONFLICT (comment_id, user_id) DO UPDATE SET value = excluded.value, updated_at = $4`,
+				key, userKey, vote, time.Now().UTC())
+		}
+		if err != nil {
+			return internalError("unable to vote at %s: %w", op, err)
+		}
+
+		up, down := voteDeltas(old, vote)
+		comment, err = scanComment(tx.QueryRow(ctx, `UPDATE comments SET upvotes = upvotes + $2,
+						downvotes = downvotes + $3 WHERE id = $1 RETURNING `+commentColumns, key, up, down))
+		if err != nil {
+			return internalError("unable to count votes at %s: %w", op, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return comment, nil
+}
+
+// GetVotes returns votes of the user for comments, comments without a vote of the user are skipped
+func (s *sqlStorage) GetVotes(ctx context.Context, userId string, commentIds []string) (map[string]model.VoteValue, error) {
+	const op = "storage.queries.GetVotes"
+
+	votes := make(map[string]model.VoteValue)
+	userKey, err := globalid.Decode(globalid.User, userId)
+	if err != nil {
+		return votes, nil
+	}
+
+	rows, err := s.db.Query(ctx, `SELECT comment_id, value FROM votes WHERE user_id = $1 AND `+
+		s.dialect.in("comment_id", 2), userKey, s.dialect.keys(globalid.DecodeAll(globalid.Comment, commentIds)))
+	if err != nil {
+		return nil, internalError("unable to get votes at %s: %w", op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key int64
+		var vote int8
+		if err = rows.Scan(&key, &vote); err != nil {
+			return nil, internalError("unable to scan vote at %s: %w", op, err)
+		}
+		votes[globalid.Encode(globalid.Comment, key)] = voteValue(vote)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, internalError("unable to read votes at %s: %w", op, err)
+	}
+	return votes, nil
+}
+
+// SetCommentsAllowed opens or closes the post for comments and returns this post.
+// Reason is kept only when comments are closed. It returns error if there is no such post or user is not its author.
+func (s *sqlStorage) SetCommentsAllowed(ctx context.Context, userId, postId string, allowed bool, reason *string) (*model.Post, error) {
+	const op = "storage.queries.SetCommentsAllowed"
+
+	// Closing already closed post keeps the time it was closed
+	if allowed {
+		reason = nil
+	}
+
+	var post *model.Post
+	err := s.write(ctx, op, func(tx querier) error {
+		key, err := s.checkAuthor(ctx, tx, op, `SELECT user_id FROM posts WHERE id = $1`, globalid.Post, userId, postId)
+		if err != nil {
+			return err
+		}
+
+		post, _, err = scanPost(tx.QueryRow(ctx, `UPDATE posts SET permission = $2,
+						comments_closed_at = CASE WHEN $2 THEN NULL ELSE COALESCE(comments_closed_at, $4) END,
+						comments_closed_reason = $3, updated_at = $4
+						WHERE id = $1 RETURNING `+postColumns, key, allowed, reason, time.Now().UTC()))
+		if err != nil {
+			return internalError("unable to update post at %s: %w", op, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return post, nil
+}
+
+// checkAuthor runs query that selects user_id of the post or the comment with id, and locks the row of the entity.
+// It returns key of the entity, or returns error if there is no such entity or user is not its author.
+func (s *sqlStorage) checkAuthor(ctx context.Context, tx querier, op, query string, t globalid.Type,
+	userId, id string) (int64, error) {
+	key, err := globalid.Decode(t, id)
+	if err != nil {
+		return 0, NewError(ErrNotFound, "%s: %v doesn't exist", t, id)
+	}
+	var authorKey int64
+	err = tx.QueryRow(ctx, query+s.dialect.forUpdate, key).Scan(&authorKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, NewError(ErrNotFound, "%s: %v doesn't exist", t, id)
+	}
+	if err != nil {
+		return 0, internalError("unable to get author of %s: %v at %s: %w", strings.ToLower(string(t)), id, op, err)
+	}
+	if globalid.Encode(globalid.User, authorKey) != userId {
+		return 0, NewError(ErrForbidden, "User: %v is not the author of %s: %v", userId, strings.ToLower(string(t)), id)
+	}
+	return key, nil
+}
+
+// postColumns are the columns of posts read by scanPost
+const postColumns = `id, user_id, title, body, permission, comments_closed_at, comments_closed_reason,
+						created_at, updated_at`
+
+// scanPost scans post from a row of postColumns, and returns the post with its id as a number
+func scanPost(row row) (*model.Post, int64, error) {
+	post := &model.Post{}
+	var key, userKey int64
+	err := row.Scan(&key, &userKey, &post.Title, &post.Text, &post.AllowComments, &post.CommentsClosedAt,
+		&post.CommentsClosedReason, &post.CreatedAt, &post.UpdatedAt)
+	if err != nil {
+		return nil, 0, err
+	}
+	post.ID = globalid.Encode(globalid.Post, key)
+	post.UserID = globalid.Encode(globalid.User, userKey)
+	return post, key, nil
+}
+
+// userColumns are the columns of users read by scanUser
+const userColumns = `id, username, email, created_at, updated_at`
+
+// scanUser scans user from a row of userColumns
+func scanUser(row row) (*model.User, error) {
+	user := &model.User{}
+	var key int64
+	err := row.Scan(&key, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	user.ID = globalid.Encode(globalid.User, key)
+	return user, nil
+}
+
+// commentColumns are the columns of comments read by scanComment
+const commentColumns = `id, user_id, post_id, parent_id, body, created_at, updated_at, deleted, depth, upvotes,
+						downvotes, (SELECT count(*) FROM comments AS c WHERE c.parent_id = comments.id)`
+
+// scanComment scans comment from a row of commentColumns
+func scanComment(row row) (*model.Comment, error) {
+	comment := &model.Comment{}
+	var key, userKey, postKey int64
+	var parentKey *int64
+	err := row.Scan(&key, &userKey, &postKey, &parentKey, &comment.Text, &comment.CreatedAt, &comment.UpdatedAt,
+		&comment.Deleted, &comment.Depth, &comment.Upvotes, &comment.Downvotes, &comment.ChildrenCount)
+	if err != nil {
+		return nil, err
+	}
+	setCommentIds(comment, key, userKey, postKey, parentKey)
+	return comment, nil
+}
+
+// setCommentIds sets ids and cursor of the comment from keys read from database,
+// top level comments have no parent_id and get the post as a parent
+func setCommentIds(comment *model.Comment, key, userKey, postKey int64, parentKey *int64) {
+	comment.ID = globalid.Encode(globalid.Comment, key)
+	comment.UserID = globalid.Encode(globalid.User, userKey)
+	comment.PostID = globalid.Encode(globalid.Post, postKey)
+	comment.ParentID = comment.PostID
+	if parentKey != nil {
+		comment.ParentID = globalid.Encode(globalid.Comment, *parentKey)
+	}
+	comment.Cursor = encodeCursor(key)
+}
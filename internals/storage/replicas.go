@@ -0,0 +1,219 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultReplicaCheckInterval = 5 * time.Second
+	replicaPingTimeout          = time.Second
+)
+
+// PostgresConfig configures connections of PostgresStorage
+type PostgresConfig struct {
+	// DSN is the connection string of the primary, it is built from Username, Password, Host, Port
+	// and Database if it is empty
+	DSN      string
+	Username string
+	Password string
+	Host     string
+	Port     string
+	Database string
+	// MaxConns and MaxConnLifetime limit the pool of the primary and of every replica,
+	// limits of pgxpool are used if they are zero
+	MaxConns        int32
+	MaxConnLifetime time.Duration
+	// Replicas are connection strings of read replicas, reads of posts, comments and users go to them
+	Replicas []string
+	// ReplicaCheckInterval is how often replicas are pinged to find out which of them are healthy
+	ReplicaCheckInterval time.Duration
+}
+
+// dsn returns the connection string of the primary
+func (cfg PostgresConfig) dsn() string {
+	if cfg.DSN != "" {
+		return cfg.DSN
+	}
+	host := cfg.Host
+	if host == "" {
+		host = defaultHost
+	}
+	return fmt.Sprintf("user=%s password=%s host=%s port=%s dbname=%s sslmode=%s",
+		cfg.Username, cfg.Password, host, cfg.Port, cfg.Database, sslmodeDisable)
+}
+
+// poolConfig parses dsn and sets the limits of the pool
+func (cfg PostgresConfig) poolConfig(dsn string) (*pgxpool.Config, error) {
+	poolCfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxConns > 0 {
+		poolCfg.MaxConns = cfg.MaxConns
+	}
+	if cfg.MaxConnLifetime > 0 {
+		poolCfg.MaxConnLifetime = cfg.MaxConnLifetime
+	}
+	return poolCfg, nil
+}
+
+// session is kept in the context of a request, it is marked by the first mutation of the request
+type session struct {
+	wrote atomic.Bool
+}
+
+type sessionKey struct{}
+
+// WithSession returns ctx of a request. Reads of the request made after its mutation go to the primary,
+// so the request sees its own writes even if replicas lag behind.
+func WithSession(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionKey{}, &session{})
+}
+
+// MarkWritten marks the session of ctx as one that has written to the primary,
+// mutations of storages call it before they write
+func MarkWritten(ctx context.Context) {
+	if s, ok := ctx.Value(sessionKey{}).(*session); ok {
+		s.wrote.Store(true)
+	}
+}
+
+// HasWritten returns true if there was a mutation in the session of ctx
+func HasWritten(ctx context.Context) bool {
+	s, ok := ctx.Value(sessionKey{}).(*session)
+	return ok && s.wrote.Load()
+}
+
+// replica is a pool of a read replica, it is skipped while it is unhealthy
+type replica struct {
+	db      *pgxpool.Pool
+	healthy atomic.Bool
+}
+
+// replicaSet spreads reads over healthy replicas round-robin, and pings them in the background
+type replicaSet struct {
+	replicas []*replica
+	next     atomic.Uint64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newReplicaSet creates pools of replicas, unreachable replicas are unhealthy until they answer a ping
+func newReplicaSet(cfg PostgresConfig) (*replicaSet, error) {
+	const op = "storage.replicas.newReplicaSet"
+
+	set := &replicaSet{stop: make(chan struct{})}
+	for _, dsn := range cfg.Replicas {
+		poolCfg, err := cfg.poolConfig(dsn)
+		if err != nil {
+			set.close()
+			return nil, fmt.Errorf("unable to parse replica connection string at %s: %w", op, err)
+		}
+		db, err := pgxpool.NewWithConfig(context.Background(), poolCfg)
+		if err != nil {
+			set.close()
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		set.replicas = append(set.replicas, &replica{db: db})
+	}
+	set.check()
+
+	interval := cfg.ReplicaCheckInterval
+	if interval <= 0 {
+		interval = defaultReplicaCheckInterval
+	}
+	set.wg.Add(1)
+	go func() {
+		defer set.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-set.stop:
+				return
+			case <-ticker.C:
+				set.check()
+			}
+		}
+	}()
+	return set, nil
+}
+
+// check pings every replica and updates its health
+func (set *replicaSet) check() {
+	for _, r := range set.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), replicaPingTimeout)
+		err := r.db.Ping(ctx)
+		cancel()
+
+		if healthy := err == nil; r.healthy.Swap(healthy) != healthy {
+			host := r.db.Config().ConnConfig.Host
+			if healthy {
+				log.Printf("Replica %s is healthy", host)
+			} else {
+				log.Printf("Replica %s is unhealthy: %v", host, err)
+			}
+		}
+	}
+}
+
+// pick returns the next healthy replica, or nil if there is none
+func (set *replicaSet) pick() *replica {
+	n := uint64(len(set.replicas))
+	for i := uint64(0); i < n; i++ {
+		r := set.replicas[set.next.Add(1)%n]
+		if r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+// close stops the checks and closes pools of replicas
+func (set *replicaSet) close() {
+	close(set.stop)
+	set.wg.Wait()
+	for _, r := range set.replicas {
+		r.db.Close()
+	}
+}
+
+// read runs f on a healthy replica, or on the primary if there is no healthy replica
+// or there was a mutation in the session of ctx. Replica that fails is marked unhealthy,
+// and f runs again on the primary.
+func (s *sqlStorage) read(ctx context.Context, f func(db querier) error) error {
+	if s.replicas == nil || HasWritten(ctx) {
+		return f(s.db)
+	}
+	r := s.replicas.pick()
+	if r == nil {
+		return f(s.db)
+	}
+
+	err := f(pgxDB{r.db})
+	if !errors.Is(err, ErrInternal) {
+		return err
+	}
+	if r.healthy.Swap(false) {
+		log.Printf("Replica %s is unhealthy: %v", r.db.Config().ConnConfig.Host, err)
+	}
+	return f(s.db)
+}
+
+// Close closes pools of the primary and of replicas
+func (s *PostgresStorage) Close() error {
+	if s.replicas != nil {
+		s.replicas.close()
+	}
+	s.DB.Close()
+	return nil
+}
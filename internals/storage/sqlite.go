@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"strconv"
+	"strings"
+)
+
+// sqliteOptions are options of the connection: foreign keys are checked for cascades,
+// WAL lets readers work while a transaction is written
+const sqliteOptions = "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+
+type SQLiteStorage struct {
+	sqlStorage
+	DB *sql.DB
+}
+
+// NewSQLiteStorage opens database file at path, creates it if it doesn't exist,
+// and applies pending migrations to it
+func NewSQLiteStorage(path string) (*SQLiteStorage, error) {
+	const op = "storage.sqlite.NewSQLiteStorage"
+
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?%s", path, sqliteOptions))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	// Sqlite has one writer at a time, single connection serializes transactions without busy errors
+	db.SetMaxOpenConns(1)
+
+	// Check if database file is ok
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("ping error %s: %w", op, err)
+	}
+
+	s := &SQLiteStorage{DB: db}
+	s.db, s.dialect, s.hub = sqlConn{sqlDB{db}, db}, sqliteDialect, NewCommentHub()
+	s.maxDepth.Store(DefaultMaxCommentDepth)
+	if err = s.migrate(context.Background()); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	log.Println("Sqlite is opened")
+	return s, nil
+}
+
+// Close closes the database file
+func (s *SQLiteStorage) Close() error {
+	return s.DB.Close()
+}
+
+// sqliteDialect passes lists of keys as json arrays and orders comment trees by strings of zero padded ids.
+// Sqlite storage has a single connection, so transactions run one by one and rows aren't locked.
+var sqliteDialect = &dialect{
+	in: func(column string, n int) string {
+		return fmt.Sprintf("%s IN (SELECT value FROM json_each($%d))", column, n)
+	},
+	keys: func(keys []int64) any {
+		values := make([]string, len(keys))
+		for i, key := range keys {
+			values[i] = strconv.FormatInt(key, 10)
+		}
+		return "[" + strings.Join(values, ",") + "]"
+	},
+	rootPath:   `printf('%020d', id)`,
+	childPath:  `t.path || '/' || printf('%020d', c.id)`,
+	constraint: sqliteConstraintViolation,
+}
+
+// Codes of sqlite errors
+var sqliteViolationCodes = map[violation]int{
+	foreignKeyViolation: sqlite3.SQLITE_CONSTRAINT_FOREIGNKEY,
+	uniqueViolation:     sqlite3.SQLITE_CONSTRAINT_UNIQUE,
+}
+
+// sqliteConstraintViolation returns "table.column" of the violated constraint if err is sqlite error of the kind,
+// foreign key violations have no details and return "FOREIGN KEY". Otherwise it returns empty string.
+func sqliteConstraintViolation(err error, kind violation) string {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.Code() != sqliteViolationCodes[kind] {
+		return ""
+	}
+	// Messages look like "constraint failed: UNIQUE constraint failed: users.email (2067)"
+	msg := strings.TrimPrefix(sqliteErr.Error(), "constraint failed: ")
+	msg, _, _ = strings.Cut(msg, " (")
+	constraint, column, _ := strings.Cut(msg, " constraint failed")
+	if column = strings.TrimPrefix(column, ": "); column != "" {
+		return column
+	}
+	return constraint
+}
+
+// sqlQuerier is a database or a transaction of database/sql
+type sqlQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// sqlDB is querier over database/sql
+type sqlDB struct {
+	db sqlQuerier
+}
+
+func (d sqlDB) Query(ctx context.Context, query string, args ...any) (rows, error) {
+	r, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return sqlRows{r}, nil
+}
+
+func (d sqlDB) QueryRow(ctx context.Context, query string, args ...any) row {
+	return d.db.QueryRowContext(ctx, query, args...)
+}
+
+func (d sqlDB) Exec(ctx context.Context, query string, args ...any) error {
+	_, err := d.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// sqlRows are rows of database/sql, errors of reading rows are reported by Err as in pgx
+type sqlRows struct {
+	*sql.Rows
+}
+
+func (r sqlRows) Close() {
+	_ = r.Rows.Close()
+}
+
+// sqlConn is conn over a database of database/sql
+type sqlConn struct {
+	sqlDB
+	pool *sql.DB
+}
+
+func (c sqlConn) Begin(ctx context.Context) (tx, error) {
+	t, err := c.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sqlTx{sqlDB{t}, t}, nil
+}
+
+// sqlTx is tx over a transaction of database/sql
+type sqlTx struct {
+	sqlDB
+	tx *sql.Tx
+}
+
+func (t sqlTx) Commit(context.Context) error {
+	return t.tx.Commit()
+}
+
+func (t sqlTx) Rollback() error {
+	err := t.tx.Rollback()
+	if errors.Is(err, sql.ErrTxDone) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,21 @@
+package storage_test
+
+import (
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage/storagetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, err := storage.NewSQLiteStorage(filepath.Join(t.TempDir(), "test.db"))
+		if err != nil {
+			t.Fatalf("NewSQLiteStorage: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = s.Close()
+		})
+		return s
+	})
+}
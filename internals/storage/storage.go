@@ -1,13 +1,125 @@
 package storage
 
 import (
+	"context"
 	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
 )
 
+const (
+	maxCommentLength = 2000
+
+	// DefaultMaxCommentDepth is the maximum depth of comments until it is set by SetMaxCommentDepth of a storage
+	DefaultMaxCommentDepth = 32
+
+	// WholeTree is maxDepth for GetPost that loads all levels of comments, maxDepth 0 loads none
+	WholeTree = -1
+
+	// allReplies is maxBreadth of a comment tree that loads every reply of every comment
+	allReplies = -1
+
+	// commentWindowBreadth is the most replies of a comment that GetComment loads, comment with more replies
+	// is returned without them, and they are read page by page
+	commentWindowBreadth = defaultPageSize
+)
+
 type Storage interface {
-	AddUser(name, email string) (*model.User, error)
-	AddPost(userID string, title string, text string, allowComments bool) (*model.Post, error)
-	AddComment(userId, postId, parentId, text string) (*model.Comment, error)
-	GetPost(postId string) (*model.Post, error)
-	GetAllPosts() ([]*model.Post, error)
+	AddUser(ctx context.Context, name, email string) (*model.User, error)
+	AddPost(ctx context.Context, userID string, title string, text string, allowComments bool) (*model.Post, error)
+	AddComment(ctx context.Context, userId, postId, parentId, text string) (*model.Comment, error)
+	GetPost(ctx context.Context, postId string, maxDepth int32) (*model.Post, error)
+	GetAllPosts(ctx context.Context) ([]*model.Post, error)
+	GetPosts(ctx context.Context, page Page) (*model.PostConnection, error)
+	GetCommentsByPosts(ctx context.Context, postIds []string, page Page) (map[string]*model.CommentConnection, error)
+	GetChildrenByComments(ctx context.Context, commentIds []string, page Page) (map[string]*model.CommentConnection, error)
+	GetComment(ctx context.Context, commentId string, maxDepth int32) (*model.Comment, error)
+	GetComments(ctx context.Context, commentIds []string) (map[string]*model.Comment, error)
+	GetAncestorsByComments(ctx context.Context, commentIds []string) (map[string][]*model.Comment, error)
+	GetPostsByUsers(ctx context.Context, userIds []string) (map[string][]*model.Post, error)
+	GetUser(ctx context.Context, userId string) (*model.User, error)
+	GetUserByUsername(ctx context.Context, username string) (*model.User, error)
+	GetUsers(ctx context.Context) ([]*model.User, error)
+	UpdatePost(ctx context.Context, userId, postId string, title, text *string) (*model.Post, error)
+	DeletePost(ctx context.Context, userId, postId string) error
+	UpdateComment(ctx context.Context, userId, commentId, text string) (*model.Comment, error)
+	DeleteComment(ctx context.Context, userId, commentId string) error
+	SetCommentsAllowed(ctx context.Context, userId, postId string, allowed bool, reason *string) (*model.Post, error)
+	VoteComment(ctx context.Context, userId, commentId string, value model.VoteValue) (*model.Comment, error)
+	GetVotes(ctx context.Context, userId string, commentIds []string) (map[string]model.VoteValue, error)
+	SubscribeComments(ctx context.Context, postId string) (<-chan *model.Comment, error)
+}
+
+// checkCommentText returns error if comment is empty or more then 2000 symbols
+func checkCommentText(text string) error {
+	if text == "" {
+		return NewError(ErrValidation, "Comment: %v is empty", text)
+	}
+	if len([]rune(text)) > maxCommentLength {
+		return NewError(ErrValidation, "Comment: %v is too long, it should be no more then a %v symbols", text, maxCommentLength)
+	}
+	return nil
+}
+
+// checkCommentDepth returns error if a reply to the parent comment at depth is deeper than maxDepth,
+// maxDepth 0 means no limit
+func checkCommentDepth(parentId string, depth, maxDepth int32) error {
+	if maxDepth > 0 && depth >= maxDepth {
+		return NewError(ErrValidation, "Comment: %v is at depth %v, replies are allowed up to depth %v",
+			parentId, depth, maxDepth)
+	}
+	return nil
+}
+
+// fitsBreadth returns true if replies of a comment with children replies are loaded in a tree with maxBreadth
+func fitsBreadth(children, maxBreadth int32) bool {
+	return maxBreadth == allReplies || children <= maxBreadth
+}
+
+// commentsClosedError returns error for adding comment to the post closed for comments
+func commentsClosedError(postId string, reason *string) error {
+	if reason != nil && *reason != "" {
+		return NewError(ErrCommentsDisabled, "Comments for post: %v are not allowed: %v", postId, *reason)
+	}
+	return NewError(ErrCommentsDisabled, "Comments for post: %v are not allowed", postId)
+}
+
+// voteOf returns the vote as it is stored: 1 for UP, -1 for DOWN and 0 for NONE
+func voteOf(value model.VoteValue) (int8, error) {
+	switch value {
+	case model.VoteValueUp:
+		return 1, nil
+	case model.VoteValueDown:
+		return -1, nil
+	case model.VoteValueNone:
+		return 0, nil
+	}
+	return 0, NewError(ErrValidation, "Vote: %v is not valid", value)
+}
+
+// voteValue returns the value of the stored vote
+func voteValue(vote int8) model.VoteValue {
+	switch {
+	case vote > 0:
+		return model.VoteValueUp
+	case vote < 0:
+		return model.VoteValueDown
+	}
+	return model.VoteValueNone
+}
+
+// voteDeltas returns changes of upvotes and downvotes of a comment when a vote for it changes from old to vote
+func voteDeltas(old, vote int8) (int32, int32) {
+	var up, down int32
+	switch old {
+	case 1:
+		up--
+	case -1:
+		down--
+	}
+	switch vote {
+	case 1:
+		up++
+	case -1:
+		down++
+	}
+	return up, down
 }
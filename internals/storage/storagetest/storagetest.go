@@ -0,0 +1,1143 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/graph/model"
+	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run runs the conformance suite against storage.Storage implementation,
+// newStorage must return an empty storage for every test
+func Run(t *testing.T, newStorage func(t *testing.T) storage.Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, s storage.Storage)
+	}{
+		{"Users", testUsers},
+		{"Posts", testPosts},
+		{"PostsPagination", testPostsPagination},
+		{"UpdateDeletePosts", testUpdateDeletePosts},
+		{"CommentTree", testCommentTree},
+		{"CommentsPagination", testCommentsPagination},
+		{"CommentSort", testCommentSort},
+		{"CommentText", testCommentText},
+		{"CommentDepth", testCommentDepth},
+		{"Permalink", testPermalink},
+		{"Permissions", testPermissions},
+		{"DeleteComments", testDeleteComments},
+		{"Votes", testVotes},
+		{"Subscriptions", testSubscriptions},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"Context", testContext},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, newStorage(t))
+		})
+	}
+}
+
+func testUsers(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	bob := addUser(t, s, "bob")
+	if alice.ID == bob.ID {
+		t.Fatalf("users have the same id: %v", alice.ID)
+	}
+	if alice.Username != "alice" || alice.Email != "alice@example.com" {
+		t.Errorf("AddUser returned %+v", alice)
+	}
+	if alice.CreatedAt.IsZero() || alice.UpdatedAt.IsZero() {
+		t.Errorf("AddUser returned user without timestamps: %+v", alice)
+	}
+
+	user, err := s.GetUser(ctx, alice.ID)
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if user.ID != alice.ID || user.Username != alice.Username || user.Email != alice.Email {
+		t.Errorf("GetUser returned %+v, want %+v", user, alice)
+	}
+	user, err = s.GetUserByUsername(ctx, "bob")
+	if err != nil {
+		t.Fatalf("GetUserByUsername: %v", err)
+	}
+	if user.ID != bob.ID {
+		t.Errorf("GetUserByUsername returned user: %v, want %v", user.ID, bob.ID)
+	}
+
+	users, err := s.GetUsers(ctx)
+	if err != nil {
+		t.Fatalf("GetUsers: %v", err)
+	}
+	if got := userIds(users); !slices.Equal(got, []string{alice.ID, bob.ID}) {
+		t.Errorf("GetUsers returned %v, want users in the order they were added", got)
+	}
+
+	_, err = s.AddUser(ctx, "alice", "other@example.com")
+	requireKind(t, err, storage.ErrConflict)
+	_, err = s.AddUser(ctx, "other", "bob@example.com")
+	requireKind(t, err, storage.ErrConflict)
+	_, err = s.GetUser(ctx, missingId)
+	requireKind(t, err, storage.ErrNotFound)
+	_, err = s.GetUserByUsername(ctx, "nobody")
+	requireKind(t, err, storage.ErrNotFound)
+}
+
+func testPosts(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	bob := addUser(t, s, "bob")
+
+	open := addPost(t, s, alice.ID, true)
+	if open.UserID != alice.ID || open.Title != "title" || open.Text != "text" || !open.AllowComments {
+		t.Errorf("AddPost returned %+v", open)
+	}
+	if open.CommentsClosedAt != nil {
+		t.Errorf("post open for comments has closing time: %v", open.CommentsClosedAt)
+	}
+	if open.CreatedAt.IsZero() || open.UpdatedAt.IsZero() {
+		t.Errorf("AddPost returned post without timestamps: %+v", open)
+	}
+	closed := addPost(t, s, bob.ID, false)
+	if closed.AllowComments || closed.CommentsClosedAt == nil {
+		t.Errorf("post closed for comments is returned as %+v", closed)
+	}
+	other := addPost(t, s, alice.ID, true)
+
+	post, err := s.GetPost(ctx, open.ID, 0)
+	if err != nil {
+		t.Fatalf("GetPost: %v", err)
+	}
+	if post.ID != open.ID || post.UserID != open.UserID || post.Title != open.Title || post.Text != open.Text {
+		t.Errorf("GetPost returned %+v, want %+v", post, open)
+	}
+
+	posts, err := s.GetAllPosts(ctx)
+	if err != nil {
+		t.Fatalf("GetAllPosts: %v", err)
+	}
+	if got := postIds(posts); !slices.Equal(got, []string{open.ID, closed.ID, other.ID}) {
+		t.Errorf("GetAllPosts returned %v, want posts in the order they were added", got)
+	}
+
+	byUsers, err := s.GetPostsByUsers(ctx, []string{alice.ID, bob.ID, missingId})
+	if err != nil {
+		t.Fatalf("GetPostsByUsers: %v", err)
+	}
+	if got := postIds(byUsers[alice.ID]); !slices.Equal(got, []string{open.ID, other.ID}) {
+		t.Errorf("GetPostsByUsers returned %v for the first user", got)
+	}
+	if got := postIds(byUsers[bob.ID]); !slices.Equal(got, []string{closed.ID}) {
+		t.Errorf("GetPostsByUsers returned %v for the second user", got)
+	}
+	if got := byUsers[missingId]; len(got) != 0 {
+		t.Errorf("GetPostsByUsers returned %v for unknown user", postIds(got))
+	}
+
+	_, err = s.AddPost(ctx, missingId, "title", "text", true)
+	requireKind(t, err, storage.ErrNotFound)
+	_, err = s.AddPost(ctx, alice.ID, "", "text", true)
+	requireKind(t, err, storage.ErrValidation)
+	_, err = s.AddPost(ctx, alice.ID, "title", "", true)
+	requireKind(t, err, storage.ErrValidation)
+	_, err = s.GetPost(ctx, missingId, 0)
+	requireKind(t, err, storage.ErrNotFound)
+}
+
+func testPostsPagination(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, addPost(t, s, alice.ID, true).ID)
+	}
+
+	// Newest first
+	page, err := s.GetPosts(ctx, storage.Page{First: int32Ptr(2)})
+	if err != nil {
+		t.Fatalf("GetPosts: %v", err)
+	}
+	requirePosts(t, page, []string{ids[4], ids[3]}, true, false)
+	if page.TotalCount != 5 {
+		t.Errorf("GetPosts returned total count: %v, want 5", page.TotalCount)
+	}
+	newest := page.PageInfo.StartCursor
+
+	page, err = s.GetPosts(ctx, storage.Page{First: int32Ptr(2), After: page.PageInfo.EndCursor})
+	if err != nil {
+		t.Fatalf("GetPosts after cursor: %v", err)
+	}
+	requirePosts(t, page, []string{ids[2], ids[1]}, true, true)
+
+	page, err = s.GetPosts(ctx, storage.Page{First: int32Ptr(2), After: page.PageInfo.EndCursor})
+	if err != nil {
+		t.Fatalf("GetPosts after cursor: %v", err)
+	}
+	requirePosts(t, page, []string{ids[0]}, false, true)
+
+	// Empty page past the oldest post still has newer posts before it
+	page, err = s.GetPosts(ctx, storage.Page{First: int32Ptr(2), After: page.PageInfo.EndCursor})
+	if err != nil {
+		t.Fatalf("GetPosts after the oldest post: %v", err)
+	}
+	requirePosts(t, page, nil, false, true)
+
+	// Backward paging returns the page in the same order
+	page, err = s.GetPosts(ctx, storage.Page{Last: int32Ptr(2)})
+	if err != nil {
+		t.Fatalf("GetPosts last: %v", err)
+	}
+	requirePosts(t, page, []string{ids[1], ids[0]}, false, true)
+
+	page, err = s.GetPosts(ctx, storage.Page{Last: int32Ptr(2), Before: page.PageInfo.StartCursor})
+	if err != nil {
+		t.Fatalf("GetPosts before cursor: %v", err)
+	}
+	requirePosts(t, page, []string{ids[3], ids[2]}, true, true)
+
+	// And empty page before the newest post has older posts after it
+	page, err = s.GetPosts(ctx, storage.Page{Last: int32Ptr(2), Before: newest})
+	if err != nil {
+		t.Fatalf("GetPosts before the newest post: %v", err)
+	}
+	requirePosts(t, page, nil, true, false)
+
+	invalid := "invalid"
+	_, err = s.GetPosts(ctx, storage.Page{First: int32Ptr(1), Last: int32Ptr(1)})
+	requireKind(t, err, storage.ErrValidation)
+	_, err = s.GetPosts(ctx, storage.Page{First: int32Ptr(-1)})
+	requireKind(t, err, storage.ErrValidation)
+	_, err = s.GetPosts(ctx, storage.Page{After: &invalid})
+	requireKind(t, err, storage.ErrValidation)
+}
+
+func testUpdateDeletePosts(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	bob := addUser(t, s, "bob")
+	post := addPost(t, s, alice.ID, true)
+	comment := addComment(t, s, bob.ID, post.ID, post.ID)
+	addComment(t, s, bob.ID, post.ID, comment.ID)
+
+	title := "new title"
+	updated, err := s.UpdatePost(ctx, alice.ID, post.ID, &title, nil)
+	if err != nil {
+		t.Fatalf("UpdatePost: %v", err)
+	}
+	if updated.Title != title || updated.Text != post.Text {
+		t.Errorf("UpdatePost returned %+v, want only title to be changed", updated)
+	}
+	if updated.UpdatedAt.Before(updated.CreatedAt) {
+		t.Errorf("UpdatePost returned post updated at: %v before it was created at: %v",
+			updated.UpdatedAt, updated.CreatedAt)
+	}
+
+	empty := ""
+	_, err = s.UpdatePost(ctx, bob.ID, post.ID, &title, nil)
+	requireKind(t, err, storage.ErrForbidden)
+	_, err = s.UpdatePost(ctx, alice.ID, post.ID, &empty, nil)
+	requireKind(t, err, storage.ErrValidation)
+	_, err = s.UpdatePost(ctx, alice.ID, missingId, &title, nil)
+	requireKind(t, err, storage.ErrNotFound)
+
+	requireKind(t, s.DeletePost(ctx, bob.ID, post.ID), storage.ErrForbidden)
+	requireKind(t, s.DeletePost(ctx, alice.ID, missingId), storage.ErrNotFound)
+	if err = s.DeletePost(ctx, alice.ID, post.ID); err != nil {
+		t.Fatalf("DeletePost: %v", err)
+	}
+	_, err = s.GetPost(ctx, post.ID, 0)
+	requireKind(t, err, storage.ErrNotFound)
+	_, err = s.UpdateComment(ctx, bob.ID, comment.ID, "text")
+	requireKind(t, err, storage.ErrNotFound)
+
+	byUsers, err := s.GetPostsByUsers(ctx, []string{alice.ID})
+	if err != nil {
+		t.Fatalf("GetPostsByUsers: %v", err)
+	}
+	if got := byUsers[alice.ID]; len(got) != 0 {
+		t.Errorf("GetPostsByUsers returned deleted posts: %v", postIds(got))
+	}
+}
+
+func testCommentTree(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	post := addPost(t, s, alice.ID, true)
+
+	first := addComment(t, s, alice.ID, post.ID, post.ID)
+	second := addComment(t, s, alice.ID, post.ID, post.ID)
+	reply := addComment(t, s, alice.ID, post.ID, first.ID)
+	nested := addComment(t, s, alice.ID, post.ID, reply.ID)
+
+	if first.PostID != post.ID || first.ParentID != post.ID {
+		t.Errorf("top level comment has post: %v and parent: %v, want %v", first.PostID, first.ParentID, post.ID)
+	}
+	if reply.PostID != post.ID || reply.ParentID != first.ID {
+		t.Errorf("reply has post: %v and parent: %v, want %v and %v", reply.PostID, reply.ParentID,
+			post.ID, first.ID)
+	}
+	if first.CreatedAt.IsZero() || first.UpdatedAt.IsZero() {
+		t.Errorf("AddComment returned comment without timestamps: %+v", first)
+	}
+
+	tree, err := s.GetPost(ctx, post.ID, storage.WholeTree)
+	if err != nil {
+		t.Fatalf("GetPost whole tree: %v", err)
+	}
+	if !tree.CommentsLoaded {
+		t.Fatalf("GetPost whole tree returned post without loaded comments")
+	}
+	if got := commentIds(tree.Comments); !slices.Equal(got, []string{first.ID, second.ID}) {
+		t.Fatalf("GetPost returned top level comments %v, want %v", got, []string{first.ID, second.ID})
+	}
+	top := tree.Comments[0]
+	if top.ChildrenCount != 1 || !top.ChildrenLoaded || !slices.Equal(commentIds(top.Children), []string{reply.ID}) {
+		t.Fatalf("GetPost returned first comment with %v replies: %v", top.ChildrenCount, commentIds(top.Children))
+	}
+	if got := commentIds(top.Children[0].Children); !slices.Equal(got, []string{nested.ID}) {
+		t.Errorf("GetPost returned nested replies %v, want %v", got, []string{nested.ID})
+	}
+	if top.Children[0].ParentID != first.ID || top.Children[0].PostID != post.ID {
+		t.Errorf("GetPost returned reply with post: %v and parent: %v", top.Children[0].PostID,
+			top.Children[0].ParentID)
+	}
+
+	// Comments deeper than maxDepth are not loaded
+	tree, err = s.GetPost(ctx, post.ID, 1)
+	if err != nil {
+		t.Fatalf("GetPost one level: %v", err)
+	}
+	if got := commentIds(tree.Comments); !slices.Equal(got, []string{first.ID, second.ID}) {
+		t.Fatalf("GetPost one level returned comments %v", got)
+	}
+	if top = tree.Comments[0]; top.ChildrenLoaded || len(top.Children) != 0 || top.ChildrenCount != 1 {
+		t.Errorf("GetPost one level returned first comment with loaded: %v, replies: %v and count: %v",
+			top.ChildrenLoaded, commentIds(top.Children), top.ChildrenCount)
+	}
+	tree, err = s.GetPost(ctx, post.ID, 0)
+	if err != nil {
+		t.Fatalf("GetPost without comments: %v", err)
+	}
+	if tree.CommentsLoaded {
+		t.Errorf("GetPost without comments returned post with loaded comments")
+	}
+
+	pages, err := s.GetCommentsByPosts(ctx, []string{post.ID, missingId}, storage.Page{})
+	if err != nil {
+		t.Fatalf("GetCommentsByPosts: %v", err)
+	}
+	requireComments(t, pages[post.ID], []string{first.ID, second.ID}, false, false)
+	requireComments(t, pages[missingId], nil, false, false)
+
+	pages, err = s.GetChildrenByComments(ctx, []string{first.ID, second.ID, missingId}, storage.Page{})
+	if err != nil {
+		t.Fatalf("GetChildrenByComments: %v", err)
+	}
+	requireComments(t, pages[first.ID], []string{reply.ID}, false, false)
+	requireComments(t, pages[second.ID], nil, false, false)
+	requireComments(t, pages[missingId], nil, false, false)
+
+	_, err = s.AddComment(ctx, missingId, post.ID, post.ID, "text")
+	requireKind(t, err, storage.ErrNotFound)
+	_, err = s.AddComment(ctx, alice.ID, missingId, missingId, "text")
+	requireKind(t, err, storage.ErrNotFound)
+}
+
+func testCommentsPagination(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	post := addPost(t, s, alice.ID, true)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, addComment(t, s, alice.ID, post.ID, post.ID).ID)
+	}
+
+	// Oldest first
+	pages, err := s.GetCommentsByPosts(ctx, []string{post.ID}, storage.Page{First: int32Ptr(2)})
+	if err != nil {
+		t.Fatalf("GetCommentsByPosts: %v", err)
+	}
+	requireComments(t, pages[post.ID], ids[:2], true, false)
+
+	pages, err = s.GetCommentsByPosts(ctx, []string{post.ID},
+		storage.Page{First: int32Ptr(2), After: pages[post.ID].PageInfo.EndCursor})
+	if err != nil {
+		t.Fatalf("GetCommentsByPosts after cursor: %v", err)
+	}
+	requireComments(t, pages[post.ID], ids[2:4], true, true)
+
+	// Cursors of the preloaded tree are the same as cursors of pages
+	tree, err := s.GetPost(ctx, post.ID, 1)
+	if err != nil {
+		t.Fatalf("GetPost: %v", err)
+	}
+	page, err := storage.PageComments(tree.Comments, storage.Page{First: int32Ptr(2), After: &tree.Comments[1].Cursor})
+	if err != nil {
+		t.Fatalf("PageComments of the preloaded tree: %v", err)
+	}
+	requireComments(t, page, ids[2:4], true, true)
+}
+
+func testCommentSort(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	bob := addUser(t, s, "bob")
+	carol := addUser(t, s, "carol")
+	post := addPost(t, s, alice.ID, true)
+	parent := addComment(t, s, alice.ID, post.ID, post.ID)
+
+	// Top level comments and replies get the same votes, scores are 1, 1, -1, 0
+	var top, replies []string
+	for _, parentId := range []string{post.ID, parent.ID} {
+		var ids []string
+		for i := 0; i < 4; i++ {
+			ids = append(ids, addComment(t, s, alice.ID, post.ID, parentId).ID)
+		}
+		for _, vote := range []struct {
+			user  *model.User
+			i     int
+			value model.VoteValue
+		}{
+			{alice, 0, model.VoteValueUp},
+			{alice, 1, model.VoteValueUp},
+			{bob, 1, model.VoteValueUp},
+			{carol, 1, model.VoteValueDown},
+			{bob, 2, model.VoteValueDown},
+			{bob, 3, model.VoteValueUp},
+			{carol, 3, model.VoteValueDown},
+		} {
+			if _, err := s.VoteComment(ctx, vote.user.ID, ids[vote.i], vote.value); err != nil {
+				t.Fatalf("VoteComment: %v", err)
+			}
+		}
+		if parentId == post.ID {
+			top = ids
+		} else {
+			replies = ids
+		}
+	}
+	top = append([]string{parent.ID}, top...)
+
+	// Ties go to newer comments, parent without votes is the oldest one
+	tests := []struct {
+		sort    model.CommentSort
+		top     []string
+		replies []string
+	}{
+		{"", top, replies},
+		{model.CommentSortOldest, top, replies},
+		{model.CommentSortNewest,
+			[]string{top[4], top[3], top[2], top[1], top[0]},
+			[]string{replies[3], replies[2], replies[1], replies[0]}},
+		{model.CommentSortTop,
+			[]string{top[2], top[1], top[4], top[0], top[3]},
+			[]string{replies[1], replies[0], replies[3], replies[2]}},
+		{model.CommentSortControversial,
+			[]string{top[2], top[4], top[3], top[1], top[0]},
+			[]string{replies[1], replies[3], replies[2], replies[0]}},
+	}
+	tree, err := s.GetPost(ctx, post.ID, storage.WholeTree)
+	if err != nil {
+		t.Fatalf("GetPost: %v", err)
+	}
+	for _, tt := range tests {
+		// Pages of storage and of the preloaded tree are the same, and their cursors continue each other
+		first := storage.Page{First: int32Ptr(2), Sort: tt.sort}
+		pages, err := s.GetCommentsByPosts(ctx, []string{post.ID}, first)
+		if err != nil {
+			t.Fatalf("GetCommentsByPosts %v: %v", tt.sort, err)
+		}
+		requireSortedComments(t, pages[post.ID], tt.sort, tt.top[:2], true, false)
+		preloaded, err := storage.PageComments(tree.Comments, first)
+		if err != nil {
+			t.Fatalf("PageComments %v: %v", tt.sort, err)
+		}
+		requireSortedComments(t, preloaded, tt.sort, tt.top[:2], true, false)
+
+		next := storage.Page{First: int32Ptr(10), After: preloaded.PageInfo.EndCursor, Sort: tt.sort}
+		pages, err = s.GetCommentsByPosts(ctx, []string{post.ID}, next)
+		if err != nil {
+			t.Fatalf("GetCommentsByPosts %v after cursor: %v", tt.sort, err)
+		}
+		requireSortedComments(t, pages[post.ID], tt.sort, tt.top[2:], false, true)
+		next.After = &pages[post.ID].Edges[0].Cursor
+		preloaded, err = storage.PageComments(tree.Comments, next)
+		if err != nil {
+			t.Fatalf("PageComments %v after cursor: %v", tt.sort, err)
+		}
+		requireSortedComments(t, preloaded, tt.sort, tt.top[3:], false, true)
+
+		children, err := s.GetChildrenByComments(ctx, []string{parent.ID}, storage.Page{Sort: tt.sort})
+		if err != nil {
+			t.Fatalf("GetChildrenByComments %v: %v", tt.sort, err)
+		}
+		requireSortedComments(t, children[parent.ID], tt.sort, tt.replies, false, false)
+		preloaded, err = storage.PageComments(tree.Comments[0].Children, storage.Page{Sort: tt.sort})
+		if err != nil {
+			t.Fatalf("PageComments of replies %v: %v", tt.sort, err)
+		}
+		requireSortedComments(t, preloaded, tt.sort, tt.replies, false, false)
+	}
+
+	// Cursor of one sort is not valid in another one
+	pages, err := s.GetCommentsByPosts(ctx, []string{post.ID}, storage.Page{Sort: model.CommentSortTop})
+	if err != nil {
+		t.Fatalf("GetCommentsByPosts: %v", err)
+	}
+	_, err = s.GetCommentsByPosts(ctx, []string{post.ID},
+		storage.Page{After: pages[post.ID].PageInfo.EndCursor, Sort: model.CommentSortNewest})
+	requireKind(t, err, storage.ErrValidation)
+	_, err = s.GetCommentsByPosts(ctx, []string{post.ID}, storage.Page{Sort: "RANDOM"})
+	requireKind(t, err, storage.ErrValidation)
+}
+
+func testCommentText(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	post := addPost(t, s, alice.ID, true)
+
+	_, err := s.AddComment(ctx, alice.ID, post.ID, post.ID, "")
+	requireKind(t, err, storage.ErrValidation)
+	_, err = s.AddComment(ctx, alice.ID, post.ID, post.ID, strings.Repeat("ж", 2001))
+	requireKind(t, err, storage.ErrValidation)
+
+	// The limit is in symbols, not in bytes
+	long := strings.Repeat("ж", 2000)
+	comment, err := s.AddComment(ctx, alice.ID, post.ID, post.ID, long)
+	if err != nil {
+		t.Fatalf("AddComment with 2000 symbols: %v", err)
+	}
+	if comment.Text != long {
+		t.Errorf("AddComment changed the text")
+	}
+
+	_, err = s.UpdateComment(ctx, alice.ID, comment.ID, "")
+	requireKind(t, err, storage.ErrValidation)
+	updated, err := s.UpdateComment(ctx, alice.ID, comment.ID, "new text")
+	if err != nil {
+		t.Fatalf("UpdateComment: %v", err)
+	}
+	if updated.ID != comment.ID || updated.Text != "new text" || updated.ParentID != post.ID {
+		t.Errorf("UpdateComment returned %+v", updated)
+	}
+}
+
+func testCommentDepth(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	post := addPost(t, s, alice.ID, true)
+
+	// Chain of replies reaches the default limit, every comment is one level deeper than its parent
+	parentId := post.ID
+	var chain []string
+	for depth := int32(1); depth <= storage.DefaultMaxCommentDepth; depth++ {
+		comment := addComment(t, s, alice.ID, post.ID, parentId)
+		if comment.Depth != depth {
+			t.Fatalf("AddComment returned comment at depth: %v, want %v", comment.Depth, depth)
+		}
+		parentId = comment.ID
+		chain = append(chain, comment.ID)
+	}
+	_, err := s.AddComment(ctx, alice.ID, post.ID, parentId, "too deep")
+	requireKind(t, err, storage.ErrValidation)
+
+	// Comments above the limit still take replies
+	sibling := addComment(t, s, alice.ID, post.ID, chain[len(chain)-2])
+	if sibling.Depth != storage.DefaultMaxCommentDepth {
+		t.Errorf("AddComment returned comment at depth: %v, want %v", sibling.Depth, storage.DefaultMaxCommentDepth)
+	}
+
+	// Depth is read back with the tree and with pages of comments
+	tree, err := s.GetPost(ctx, post.ID, storage.WholeTree)
+	if err != nil {
+		t.Fatalf("GetPost: %v", err)
+	}
+	depth := int32(1)
+	for comments := tree.Comments; len(comments) > 0; comments = comments[0].Children {
+		if comments[0].Depth != depth {
+			t.Fatalf("GetPost returned comment: %v at depth: %v, want %v", comments[0].ID, comments[0].Depth, depth)
+		}
+		depth++
+	}
+	pages, err := s.GetChildrenByComments(ctx, []string{chain[0]}, storage.Page{})
+	if err != nil {
+		t.Fatalf("GetChildrenByComments: %v", err)
+	}
+	if edges := pages[chain[0]].Edges; len(edges) != 1 || edges[0].Node.Depth != 2 {
+		t.Errorf("GetChildrenByComments returned %v replies, want one at depth 2", len(edges))
+	}
+	updated, err := s.UpdateComment(ctx, alice.ID, sibling.ID, "new text")
+	if err != nil {
+		t.Fatalf("UpdateComment: %v", err)
+	}
+	if updated.Depth != sibling.Depth {
+		t.Errorf("UpdateComment returned comment at depth: %v, want %v", updated.Depth, sibling.Depth)
+	}
+}
+
+func testPermalink(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	post := addPost(t, s, alice.ID, true)
+	other := addPost(t, s, alice.ID, true)
+
+	top := addComment(t, s, alice.ID, post.ID, post.ID)
+	reply := addComment(t, s, alice.ID, post.ID, top.ID)
+	nested := addComment(t, s, alice.ID, post.ID, reply.ID)
+	leaf := addComment(t, s, alice.ID, post.ID, nested.ID)
+	missingId := "Q29tbWVudDo5OTk5"
+
+	// Replies must go to an existing comment of the same post
+	_, err := s.AddComment(ctx, alice.ID, other.ID, reply.ID, "text")
+	requireKind(t, err, storage.ErrValidation)
+	_, err = s.AddComment(ctx, alice.ID, post.ID, missingId, "text")
+	requireKind(t, err, storage.ErrNotFound)
+
+	// Missing author is reported as the user, not as the post or the parent
+	_, err = s.AddComment(ctx, "VXNlcjo5OTk5", post.ID, reply.ID, "text")
+	requireKind(t, err, storage.ErrNotFound)
+	if err != nil && !strings.HasPrefix(err.Error(), "User: ") {
+		t.Errorf("AddComment of missing user returned error: %v, want error about the user", err)
+	}
+
+	// Comment is returned with its replies up to maxDepth levels below it
+	comment, err := s.GetComment(ctx, reply.ID, 1)
+	if err != nil {
+		t.Fatalf("GetComment: %v", err)
+	}
+	if comment.ID != reply.ID || comment.ParentID != top.ID || comment.Depth != 2 || !comment.ChildrenLoaded {
+		t.Fatalf("GetComment returned %+v", comment)
+	}
+	if got := commentIds(comment.Children); !slices.Equal(got, []string{nested.ID}) {
+		t.Fatalf("GetComment returned replies %v, want %v", got, []string{nested.ID})
+	}
+	if child := comment.Children[0]; child.ChildrenLoaded || len(child.Children) != 0 || child.ChildrenCount != 1 {
+		t.Errorf("GetComment one level returned reply with loaded: %v, replies: %v and count: %v",
+			child.ChildrenLoaded, commentIds(child.Children), child.ChildrenCount)
+	}
+	comment, err = s.GetComment(ctx, reply.ID, storage.WholeTree)
+	if err != nil {
+		t.Fatalf("GetComment whole tree: %v", err)
+	}
+	if got := commentIds(comment.Children[0].Children); !slices.Equal(got, []string{leaf.ID}) {
+		t.Errorf("GetComment whole tree returned nested replies %v, want %v", got, []string{leaf.ID})
+	}
+	comment, err = s.GetComment(ctx, reply.ID, 0)
+	if err != nil {
+		t.Fatalf("GetComment without replies: %v", err)
+	}
+	if comment.ChildrenLoaded || comment.ChildrenCount != 1 {
+		t.Errorf("GetComment without replies returned loaded: %v and count: %v", comment.ChildrenLoaded,
+			comment.ChildrenCount)
+	}
+	_, err = s.GetComment(ctx, missingId, 0)
+	requireKind(t, err, storage.ErrNotFound)
+
+	// Replies of comments with more replies than a page are paged, not loaded with the comment
+	wide := addComment(t, s, alice.ID, post.ID, top.ID)
+	for i := 0; i < 21; i++ {
+		addComment(t, s, alice.ID, post.ID, wide.ID)
+	}
+	comment, err = s.GetComment(ctx, top.ID, storage.WholeTree)
+	if err != nil {
+		t.Fatalf("GetComment with wide reply: %v", err)
+	}
+	if got, want := commentIds(comment.Children), []string{reply.ID, wide.ID}; !slices.Equal(got, want) {
+		t.Fatalf("GetComment with wide reply returned replies %v, want %v", got, want)
+	}
+	if narrow := comment.Children[0]; !narrow.ChildrenLoaded || len(narrow.Children) != 1 {
+		t.Errorf("GetComment with wide reply returned narrow reply with loaded: %v and replies: %v",
+			narrow.ChildrenLoaded, commentIds(narrow.Children))
+	}
+	if child := comment.Children[1]; child.ChildrenLoaded || len(child.Children) != 0 || child.ChildrenCount != 21 {
+		t.Errorf("GetComment with wide reply returned it with loaded: %v, replies: %v and count: %v",
+			child.ChildrenLoaded, len(child.Children), child.ChildrenCount)
+	}
+	comment, err = s.GetComment(ctx, wide.ID, 1)
+	if err != nil {
+		t.Fatalf("GetComment of wide comment: %v", err)
+	}
+	if comment.ChildrenLoaded || len(comment.Children) != 0 || comment.ChildrenCount != 21 {
+		t.Errorf("GetComment of wide comment returned loaded: %v, replies: %v and count: %v",
+			comment.ChildrenLoaded, len(comment.Children), comment.ChildrenCount)
+	}
+
+	// Ancestors go from the top level comment down to the parent
+	ancestors, err := s.GetAncestorsByComments(ctx, []string{leaf.ID, nested.ID, top.ID, missingId})
+	if err != nil {
+		t.Fatalf("GetAncestorsByComments: %v", err)
+	}
+	if got, want := commentIds(ancestors[leaf.ID]), []string{top.ID, reply.ID, nested.ID}; !slices.Equal(got, want) {
+		t.Errorf("GetAncestorsByComments returned %v, want %v", got, want)
+	}
+	if got, want := commentIds(ancestors[nested.ID]), []string{top.ID, reply.ID}; !slices.Equal(got, want) {
+		t.Errorf("GetAncestorsByComments returned %v for the second comment, want %v", got, want)
+	}
+	if chain, ok := ancestors[top.ID]; !ok || len(chain) != 0 {
+		t.Errorf("GetAncestorsByComments of top level comment returned %v, %v", commentIds(chain), ok)
+	}
+	if chain, ok := ancestors[missingId]; ok {
+		t.Errorf("GetAncestorsByComments of unknown comment returned %v", commentIds(chain))
+	}
+
+	comments, err := s.GetComments(ctx, []string{top.ID, leaf.ID, missingId})
+	if err != nil {
+		t.Fatalf("GetComments: %v", err)
+	}
+	if len(comments) != 2 || comments[top.ID] == nil || comments[leaf.ID].ParentID != nested.ID {
+		t.Errorf("GetComments returned %v comments: %v", len(comments), comments)
+	}
+}
+
+func testPermissions(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	bob := addUser(t, s, "bob")
+
+	closed := addPost(t, s, alice.ID, false)
+	_, err := s.AddComment(ctx, bob.ID, closed.ID, closed.ID, "text")
+	requireKind(t, err, storage.ErrCommentsDisabled)
+
+	post := addPost(t, s, alice.ID, true)
+	comment := addComment(t, s, bob.ID, post.ID, post.ID)
+
+	_, err = s.SetCommentsAllowed(ctx, bob.ID, post.ID, false, nil)
+	requireKind(t, err, storage.ErrForbidden)
+	_, err = s.SetCommentsAllowed(ctx, alice.ID, missingId, false, nil)
+	requireKind(t, err, storage.ErrNotFound)
+
+	reason := "off topic"
+	post, err = s.SetCommentsAllowed(ctx, alice.ID, post.ID, false, &reason)
+	if err != nil {
+		t.Fatalf("SetCommentsAllowed: %v", err)
+	}
+	if post.AllowComments || post.CommentsClosedAt == nil || post.CommentsClosedReason == nil ||
+		*post.CommentsClosedReason != reason {
+		t.Fatalf("SetCommentsAllowed returned %+v", post)
+	}
+	closedAt := *post.CommentsClosedAt
+
+	_, err = s.AddComment(ctx, bob.ID, post.ID, post.ID, "text")
+	requireKind(t, err, storage.ErrCommentsDisabled)
+	if err != nil && !strings.Contains(err.Error(), reason) {
+		t.Errorf("AddComment returned error without the reason: %v", err)
+	}
+	_, err = s.AddComment(ctx, bob.ID, post.ID, comment.ID, "text")
+	requireKind(t, err, storage.ErrCommentsDisabled)
+
+	// Closing already closed post keeps the time it was closed
+	post, err = s.SetCommentsAllowed(ctx, alice.ID, post.ID, false, nil)
+	if err != nil {
+		t.Fatalf("SetCommentsAllowed again: %v", err)
+	}
+	if post.CommentsClosedAt == nil || !post.CommentsClosedAt.Equal(closedAt) {
+		t.Errorf("SetCommentsAllowed changed closing time from %v to %v", closedAt, post.CommentsClosedAt)
+	}
+
+	post, err = s.SetCommentsAllowed(ctx, alice.ID, post.ID, true, &reason)
+	if err != nil {
+		t.Fatalf("SetCommentsAllowed to open: %v", err)
+	}
+	if !post.AllowComments || post.CommentsClosedAt != nil || post.CommentsClosedReason != nil {
+		t.Errorf("SetCommentsAllowed to open returned %+v", post)
+	}
+	addComment(t, s, bob.ID, post.ID, comment.ID)
+
+	// Only the author changes the comment
+	_, err = s.UpdateComment(ctx, alice.ID, comment.ID, "text")
+	requireKind(t, err, storage.ErrForbidden)
+	requireKind(t, s.DeleteComment(ctx, alice.ID, comment.ID), storage.ErrForbidden)
+	_, err = s.UpdateComment(ctx, bob.ID, missingId, "text")
+	requireKind(t, err, storage.ErrNotFound)
+	requireKind(t, s.DeleteComment(ctx, bob.ID, missingId), storage.ErrNotFound)
+}
+
+func testDeleteComments(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	post := addPost(t, s, alice.ID, true)
+
+	leaf := addComment(t, s, alice.ID, post.ID, post.ID)
+	parent := addComment(t, s, alice.ID, post.ID, post.ID)
+	reply := addComment(t, s, alice.ID, post.ID, parent.ID)
+
+	// Comment without replies is removed
+	if err := s.DeleteComment(ctx, alice.ID, leaf.ID); err != nil {
+		t.Fatalf("DeleteComment: %v", err)
+	}
+	pages, err := s.GetCommentsByPosts(ctx, []string{post.ID}, storage.Page{})
+	if err != nil {
+		t.Fatalf("GetCommentsByPosts: %v", err)
+	}
+	requireComments(t, pages[post.ID], []string{parent.ID}, false, false)
+
+	// Comment with replies stays as a tombstone
+	if err = s.DeleteComment(ctx, alice.ID, parent.ID); err != nil {
+		t.Fatalf("DeleteComment with replies: %v", err)
+	}
+	pages, err = s.GetCommentsByPosts(ctx, []string{post.ID}, storage.Page{})
+	if err != nil {
+		t.Fatalf("GetCommentsByPosts: %v", err)
+	}
+	requireComments(t, pages[post.ID], []string{parent.ID}, false, false)
+	if tombstone := pages[post.ID].Edges[0].Node; !tombstone.Deleted || tombstone.Text != model.DeletedCommentText ||
+		tombstone.ChildrenCount != 1 {
+		t.Errorf("deleted comment with replies is returned as %+v", tombstone)
+	}
+	_, err = s.UpdateComment(ctx, alice.ID, parent.ID, "text")
+	requireKind(t, err, storage.ErrNotFound)
+	requireKind(t, s.DeleteComment(ctx, alice.ID, parent.ID), storage.ErrNotFound)
+
+	// Tombstone is removed with its last reply
+	if err = s.DeleteComment(ctx, alice.ID, reply.ID); err != nil {
+		t.Fatalf("DeleteComment of the last reply: %v", err)
+	}
+	pages, err = s.GetCommentsByPosts(ctx, []string{post.ID}, storage.Page{})
+	if err != nil {
+		t.Fatalf("GetCommentsByPosts: %v", err)
+	}
+	requireComments(t, pages[post.ID], nil, false, false)
+}
+
+func testVotes(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	bob := addUser(t, s, "bob")
+	post := addPost(t, s, alice.ID, true)
+	comment := addComment(t, s, alice.ID, post.ID, post.ID)
+	other := addComment(t, s, alice.ID, post.ID, post.ID)
+
+	// One vote per user, a new vote replaces the old one
+	for _, step := range []struct {
+		user     *model.User
+		value    model.VoteValue
+		up, down int32
+	}{
+		{bob, model.VoteValueUp, 1, 0},
+		{bob, model.VoteValueUp, 1, 0},
+		{alice, model.VoteValueDown, 1, 1},
+		{bob, model.VoteValueDown, 0, 2},
+		{alice, model.VoteValueNone, 0, 1},
+		{alice, model.VoteValueNone, 0, 1},
+	} {
+		voted, err := s.VoteComment(ctx, step.user.ID, comment.ID, step.value)
+		if err != nil {
+			t.Fatalf("VoteComment %v by %v: %v", step.value, step.user.Username, err)
+		}
+		if voted.ID != comment.ID || voted.Upvotes != step.up || voted.Downvotes != step.down {
+			t.Errorf("after %v by %v comment has %v upvotes and %v downvotes, want %v and %v",
+				step.value, step.user.Username, voted.Upvotes, voted.Downvotes, step.up, step.down)
+		}
+	}
+
+	// Reads return the same score
+	tree, err := s.GetPost(ctx, post.ID, storage.WholeTree)
+	if err != nil {
+		t.Fatalf("GetPost: %v", err)
+	}
+	if got := tree.Comments[0].Score(); got != -1 {
+		t.Errorf("comment in the tree has score %v, want -1", got)
+	}
+	pages, err := s.GetCommentsByPosts(ctx, []string{post.ID}, storage.Page{})
+	if err != nil {
+		t.Fatalf("GetCommentsByPosts: %v", err)
+	}
+	if got := pages[post.ID].Edges[0].Node.Score(); got != -1 {
+		t.Errorf("comment in the page has score %v, want -1", got)
+	}
+
+	votes, err := s.GetVotes(ctx, bob.ID, []string{comment.ID, other.ID, missingId})
+	if err != nil {
+		t.Fatalf("GetVotes: %v", err)
+	}
+	if want := map[string]model.VoteValue{comment.ID: model.VoteValueDown}; !maps.Equal(votes, want) {
+		t.Errorf("bob has votes %v, want %v", votes, want)
+	}
+	votes, err = s.GetVotes(ctx, alice.ID, []string{comment.ID, other.ID})
+	if err != nil {
+		t.Fatalf("GetVotes: %v", err)
+	}
+	if len(votes) != 0 {
+		t.Errorf("alice has votes %v after taking them back", votes)
+	}
+
+	_, err = s.VoteComment(ctx, missingId, comment.ID, model.VoteValueNone)
+	requireKind(t, err, storage.ErrNotFound)
+	_, err = s.VoteComment(ctx, bob.ID, missingId, model.VoteValueUp)
+	requireKind(t, err, storage.ErrNotFound)
+	_, err = s.VoteComment(ctx, bob.ID, comment.ID, model.VoteValue("SIDEWAYS"))
+	requireKind(t, err, storage.ErrValidation)
+
+	// Deleted comments can't be voted for
+	addComment(t, s, alice.ID, post.ID, other.ID)
+	if err = s.DeleteComment(ctx, alice.ID, other.ID); err != nil {
+		t.Fatalf("DeleteComment: %v", err)
+	}
+	_, err = s.VoteComment(ctx, bob.ID, other.ID, model.VoteValueUp)
+	requireKind(t, err, storage.ErrNotFound)
+}
+
+func testSubscriptions(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	post := addPost(t, s, alice.ID, true)
+	other := addPost(t, s, alice.ID, true)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	_, err := s.SubscribeComments(ctx, missingId)
+	requireKind(t, err, storage.ErrNotFound)
+
+	comments, err := s.SubscribeComments(ctx, post.ID)
+	if err != nil {
+		t.Fatalf("SubscribeComments: %v", err)
+	}
+	addComment(t, s, alice.ID, other.ID, other.ID)
+	comment := addComment(t, s, alice.ID, post.ID, post.ID)
+
+	select {
+	case got := <-comments:
+		if got.ID != comment.ID {
+			t.Errorf("subscriber got comment: %v, want %v", got.ID, comment.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("subscriber got no comment")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-comments:
+		if ok {
+			t.Errorf("subscriber got comment after unsubscribing")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("channel is not closed after ctx is done")
+	}
+}
+
+func testConcurrentWriters(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	const writers, perWriter = 8, 10
+
+	alice := addUser(t, s, "alice")
+	post := addPost(t, s, alice.ID, true)
+	parent := addComment(t, s, alice.ID, post.ID, post.ID)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*(perWriter+1))
+	ids := make(chan string, writers*perWriter)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				parentId := post.ID
+				if j%2 == 1 {
+					parentId = parent.ID
+				}
+				comment, err := s.AddComment(ctx, alice.ID, post.ID, parentId, fmt.Sprintf("comment %d", j))
+				if err != nil {
+					errs <- err
+					continue
+				}
+				ids <- comment.ID
+			}
+			// Only one of the writers gets the username
+			if _, err := s.AddUser(ctx, "writer", fmt.Sprintf("writer%d@example.com", i)); err != nil &&
+				!errors.Is(err, storage.ErrConflict) {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	close(ids)
+	for err := range errs {
+		t.Errorf("concurrent writer: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("comment id: %v is returned twice", id)
+		}
+		seen[id] = true
+	}
+
+	tree, err := s.GetPost(ctx, post.ID, storage.WholeTree)
+	if err != nil {
+		t.Fatalf("GetPost: %v", err)
+	}
+	if got, want := len(tree.Comments), 1+writers*perWriter/2; got != want {
+		t.Errorf("post has %v top level comments, want %v", got, want)
+	}
+	if got, want := tree.Comments[0].ChildrenCount, int32(writers*perWriter/2); got != want {
+		t.Errorf("comment has %v replies, want %v", got, want)
+	}
+
+	users, err := s.GetUsers(ctx)
+	if err != nil {
+		t.Fatalf("GetUsers: %v", err)
+	}
+	if len(users) != 2 {
+		t.Errorf("GetUsers returned %v users, want 2", len(users))
+	}
+}
+
+func testContext(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+	alice := addUser(t, s, "alice")
+	post := addPost(t, s, alice.ID, true)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err := s.AddComment(canceled, alice.ID, post.ID, post.ID, "text")
+	requireKind(t, err, storage.ErrCanceled)
+	_, err = s.GetPost(canceled, post.ID, storage.WholeTree)
+	requireKind(t, err, storage.ErrCanceled)
+
+	expired, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = s.AddUser(expired, "bob", "bob@example.com")
+	requireKind(t, err, storage.ErrDeadlineExceeded)
+	_, err = s.GetUsers(expired)
+	requireKind(t, err, storage.ErrDeadlineExceeded)
+
+	// Stopped operations change nothing
+	users, err := s.GetUsers(ctx)
+	if err != nil {
+		t.Fatalf("GetUsers: %v", err)
+	}
+	if got := userIds(users); !slices.Equal(got, []string{alice.ID}) {
+		t.Errorf("GetUsers returned %v after stopped AddUser", got)
+	}
+	pages, err := s.GetCommentsByPosts(ctx, []string{post.ID}, storage.Page{})
+	if err != nil {
+		t.Fatalf("GetCommentsByPosts: %v", err)
+	}
+	requireComments(t, pages[post.ID], nil, false, false)
+}
+
+// missingId is an id of no entity
+const missingId = "missing"
+
+func addUser(t *testing.T, s storage.Storage, name string) *model.User {
+	t.Helper()
+	user, err := s.AddUser(context.Background(), name, name+"@example.com")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	return user
+}
+
+func addPost(t *testing.T, s storage.Storage, userId string, allowComments bool) *model.Post {
+	t.Helper()
+	post, err := s.AddPost(context.Background(), userId, "title", "text", allowComments)
+	if err != nil {
+		t.Fatalf("AddPost: %v", err)
+	}
+	return post
+}
+
+func addComment(t *testing.T, s storage.Storage, userId, postId, parentId string) *model.Comment {
+	t.Helper()
+	comment, err := s.AddComment(context.Background(), userId, postId, parentId, "text")
+	if err != nil {
+		t.Fatalf("AddComment: %v", err)
+	}
+	return comment
+}
+
+// requireKind fails the test if err is not of the kind
+func requireKind(t *testing.T, err, kind error) {
+	t.Helper()
+	if !errors.Is(err, kind) {
+		t.Errorf("got error: %v, want %v", err, kind)
+	}
+}
+
+// requirePosts fails the test if page doesn't have exactly posts with ids and such page info
+func requirePosts(t *testing.T, page *model.PostConnection, ids []string, hasNext, hasPrevious bool) {
+	t.Helper()
+	var got []string
+	for _, edge := range page.Edges {
+		got = append(got, edge.Node.ID)
+	}
+	if !slices.Equal(got, ids) {
+		t.Errorf("got posts %v, want %v", got, ids)
+	}
+	if page.PageInfo.HasNextPage != hasNext || page.PageInfo.HasPreviousPage != hasPrevious {
+		t.Errorf("got hasNextPage: %v and hasPreviousPage: %v, want %v and %v",
+			page.PageInfo.HasNextPage, page.PageInfo.HasPreviousPage, hasNext, hasPrevious)
+	}
+}
+
+// requireComments fails the test if page doesn't have exactly comments with ids and such page info
+func requireComments(t *testing.T, page *model.CommentConnection, ids []string, hasNext, hasPrevious bool) {
+	t.Helper()
+	requireSortedComments(t, page, model.CommentSortOldest, ids, hasNext, hasPrevious)
+}
+
+// requireSortedComments checks a page in the given sort, cursors of nodes are the same as cursors of edges only in the
+// default sort
+func requireSortedComments(t *testing.T, page *model.CommentConnection, sort model.CommentSort, ids []string,
+	hasNext, hasPrevious bool) {
+	t.Helper()
+	if page == nil {
+		t.Errorf("got no page, want comments %v", ids)
+		return
+	}
+	var got []string
+	for _, edge := range page.Edges {
+		got = append(got, edge.Node.ID)
+		if (sort == "" || sort == model.CommentSortOldest) && edge.Cursor != edge.Node.Cursor {
+			t.Errorf("comment: %v has cursor: %v in the edge and %v in the node", edge.Node.ID, edge.Cursor,
+				edge.Node.Cursor)
+		}
+	}
+	if !slices.Equal(got, ids) {
+		t.Errorf("got comments %v, want %v", got, ids)
+	}
+	if page.PageInfo.HasNextPage != hasNext || page.PageInfo.HasPreviousPage != hasPrevious {
+		t.Errorf("got hasNextPage: %v and hasPreviousPage: %v, want %v and %v",
+			page.PageInfo.HasNextPage, page.PageInfo.HasPreviousPage, hasNext, hasPrevious)
+	}
+}
+
+func userIds(users []*model.User) []string {
+	var ids []string
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	return ids
+}
+
+func postIds(posts []*model.Post) []string {
+	var ids []string
+	for _, post := range posts {
+		ids = append(ids, post.ID)
+	}
+	return ids
+}
+
+func commentIds(comments []*model.Comment) []string {
+	var ids []string
+	for _, comment := range comments {
+		ids = append(ids, comment.ID)
+	}
+	return ids
+}
+
+func int32Ptr(n int32) *int32 {
+	return &n
+}
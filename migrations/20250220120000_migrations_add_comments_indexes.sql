@@ -0,0 +1,10 @@
+-- +goose Up
+    create index if not exists comments_post_id_top_level_idx on comments (post_id, id) where parent_id is null;
+
+    create index if not exists comments_parent_id_idx on comments (parent_id, id);
+
+-- +goose Down
+
+    drop index if exists comments_parent_id_idx;
+
+    drop index if exists comments_post_id_top_level_idx;
@@ -0,0 +1,6 @@
+-- +goose Up
+    alter table comments add column if not exists deleted bool not null default false;
+
+-- +goose Down
+
+    alter table comments drop column if exists deleted;
@@ -0,0 +1,12 @@
+-- +goose Up
+    alter table posts add column if not exists comments_closed_at timestamp;
+
+    alter table posts add column if not exists comments_closed_reason text;
+
+    update posts set comments_closed_at = current_timestamp where not permission and comments_closed_at is null;
+
+-- +goose Down
+
+    alter table posts drop column if exists comments_closed_reason;
+
+    alter table posts drop column if exists comments_closed_at;
@@ -0,0 +1,42 @@
+-- +goose Up
+    alter table users add column if not exists created_at timestamptz not null default current_timestamp;
+
+    alter table users add column if not exists updated_at timestamptz not null default current_timestamp;
+
+    alter table posts add column if not exists created_at timestamptz not null default current_timestamp;
+
+    alter table posts add column if not exists updated_at timestamptz not null default current_timestamp;
+
+    alter table posts alter column comments_closed_at type timestamptz using comments_closed_at at time zone 'UTC';
+
+    update comments set created_at = current_timestamp where created_at is null;
+
+    alter table comments alter column created_at type timestamptz using created_at at time zone 'UTC';
+
+    alter table comments alter column created_at set not null;
+
+    alter table comments add column if not exists updated_at timestamptz;
+
+    update comments set updated_at = created_at where updated_at is null;
+
+    alter table comments alter column updated_at set default current_timestamp;
+
+    alter table comments alter column updated_at set not null;
+
+-- +goose Down
+
+    alter table comments drop column if exists updated_at;
+
+    alter table comments alter column created_at drop not null;
+
+    alter table comments alter column created_at type timestamp using created_at at time zone 'UTC';
+
+    alter table posts alter column comments_closed_at type timestamp using comments_closed_at at time zone 'UTC';
+
+    alter table posts drop column if exists updated_at;
+
+    alter table posts drop column if exists created_at;
+
+    alter table users drop column if exists updated_at;
+
+    alter table users drop column if exists created_at;
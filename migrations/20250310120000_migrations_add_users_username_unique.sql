@@ -0,0 +1,6 @@
+-- +goose Up
+    alter table users add constraint users_username_key unique (username);
+
+-- +goose Down
+
+    alter table users drop constraint if exists users_username_key;
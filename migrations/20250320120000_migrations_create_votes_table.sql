@@ -0,0 +1,23 @@
+-- +goose Up
+    alter table comments add column if not exists upvotes int not null default 0;
+
+    alter table comments add column if not exists downvotes int not null default 0;
+
+    create table if not exists votes (
+        comment_id int not null,
+        user_id int not null,
+        value smallint not null check (value in (-1, 1)),
+        created_at timestamptz not null default current_timestamp,
+        updated_at timestamptz not null default current_timestamp,
+        primary key (comment_id, user_id),
+        foreign key (comment_id) references comments(id) on delete cascade,
+        foreign key (user_id) references users(id) on delete cascade
+    );
+
+-- +goose Down
+
+    drop table if exists votes;
+
+    alter table comments drop column if exists downvotes;
+
+    alter table comments drop column if exists upvotes;
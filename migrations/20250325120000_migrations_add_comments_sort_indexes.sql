@@ -0,0 +1,22 @@
+-- +goose Up
+    create index if not exists comments_post_id_top_idx on comments (post_id, (upvotes - downvotes), id)
+        where parent_id is null;
+
+    create index if not exists comments_parent_id_top_idx on comments (parent_id, (upvotes - downvotes), id);
+
+    create index if not exists comments_post_id_controversial_idx on comments (post_id,
+        (case when upvotes < downvotes then upvotes else downvotes end), (upvotes + downvotes), id)
+        where parent_id is null;
+
+    create index if not exists comments_parent_id_controversial_idx on comments (parent_id,
+        (case when upvotes < downvotes then upvotes else downvotes end), (upvotes + downvotes), id);
+
+-- +goose Down
+
+    drop index if exists comments_parent_id_controversial_idx;
+
+    drop index if exists comments_post_id_controversial_idx;
+
+    drop index if exists comments_parent_id_top_idx;
+
+    drop index if exists comments_post_id_top_idx;
@@ -0,0 +1,8 @@
+package migrations
+
+import "embed"
+
+// FS contains SQL migrations of postgres, they are applied by the server with migrate command or on start
+//
+//go:embed *.sql
+var FS embed.FS
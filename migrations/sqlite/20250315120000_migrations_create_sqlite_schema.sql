@@ -0,0 +1,51 @@
+-- +goose Up
+    create table if not exists users (
+        id integer primary key autoincrement,
+        username text not null constraint users_username_key unique,
+        email text not null constraint users_email_key unique,
+        created_at timestamp not null default current_timestamp,
+        updated_at timestamp not null default current_timestamp
+    );
+
+    create table if not exists posts (
+        id integer primary key autoincrement,
+        user_id integer not null,
+        title text not null,
+        body text not null,
+        permission bool,
+        comments_closed_at timestamp,
+        comments_closed_reason text,
+        created_at timestamp not null default current_timestamp,
+        updated_at timestamp not null default current_timestamp,
+        foreign key (user_id) references users(id) on delete cascade
+    );
+
+    create table if not exists comments(
+        id integer primary key autoincrement,
+        user_id integer not null,
+        post_id integer not null,
+        parent_id integer,
+        body text not null,
+        deleted bool not null default false,
+        created_at timestamp not null default current_timestamp,
+        updated_at timestamp not null default current_timestamp,
+        foreign key (user_id) references users(id) on delete cascade,
+        foreign key (post_id) references posts(id) on delete cascade,
+        foreign key (parent_id) references comments(id) on delete cascade
+    );
+
+    create index if not exists comments_post_id_top_level_idx on comments (post_id, id) where parent_id is null;
+
+    create index if not exists comments_parent_id_idx on comments (parent_id, id);
+
+-- +goose Down
+
+    drop index if exists comments_parent_id_idx;
+
+    drop index if exists comments_post_id_top_level_idx;
+
+    drop table comments;
+
+    drop table posts;
+
+    drop table users;
@@ -0,0 +1,23 @@
+-- +goose Up
+    alter table comments add column upvotes integer not null default 0;
+
+    alter table comments add column downvotes integer not null default 0;
+
+    create table if not exists votes (
+        comment_id integer not null,
+        user_id integer not null,
+        value integer not null check (value in (-1, 1)),
+        created_at timestamp not null default current_timestamp,
+        updated_at timestamp not null default current_timestamp,
+        primary key (comment_id, user_id),
+        foreign key (comment_id) references comments(id) on delete cascade,
+        foreign key (user_id) references users(id) on delete cascade
+    );
+
+-- +goose Down
+
+    drop table if exists votes;
+
+    alter table comments drop column downvotes;
+
+    alter table comments drop column upvotes;
@@ -0,0 +1,13 @@
+-- +goose Up
+    alter table comments add column depth integer not null default 1;
+
+    with recursive tree as (
+        select id, 1 as depth from comments where parent_id is null
+        union all
+        select c.id, t.depth + 1 from comments as c join tree as t on c.parent_id = t.id
+    )
+    update comments set depth = (select depth from tree where tree.id = comments.id) where parent_id is not null;
+
+-- +goose Down
+
+    alter table comments drop column depth;
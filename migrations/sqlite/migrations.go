@@ -0,0 +1,9 @@
+package sqlite
+
+import "embed"
+
+// FS contains SQL migrations of sqlite, they have the same tables and columns as migrations of postgres
+// and are applied by the server when the database file is opened
+//
+//go:embed *.sql
+var FS embed.FS
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/99designs/gqlgen/graphql/handler"
@@ -10,14 +13,23 @@ import (
 	"github.com/KaffeeMaschina/ozon_test_task/config"
 	graph2 "github.com/KaffeeMaschina/ozon_test_task/internals/graph"
 	"github.com/KaffeeMaschina/ozon_test_task/internals/storage"
+	"github.com/gorilla/websocket"
 	"github.com/vektah/gqlparser/v2/ast"
+	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
-	port = "8080"
+	port                  = "8080"
+	keepAlivePingInterval = 10 * time.Second
 )
 
 func main() {
@@ -29,31 +41,124 @@ func main() {
 
 	var store storage.Storage
 	var err error
-	var usePostgres bool
+	var usePostgres, autoMigrate, allowPending bool
 
-	flag.BoolVar(&usePostgres, "usePostgres", false, "use postgres instead of in memory cache")
+	flag.BoolVar(&usePostgres, "usePostgres", false, "use postgres regardless of the storage mode in config")
+	flag.BoolVar(&autoMigrate, "autoMigrate", false, "apply pending migrations to postgres on start")
+	flag.BoolVar(&allowPending, "allowPendingMigrations", false, "start even if postgres has pending migrations")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [migrate up|down|status]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	// migrate command manages the schema of postgres and exits
+	if flag.Arg(0) == "migrate" {
+		if err = migrate(log, cfg, flag.Arg(1)); err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// -usePostgres flag keeps working and takes precedence over the mode from config
+	mode := cfg.Mode
 	if usePostgres {
+		mode = config.StoragePostgres
+	}
+
+	switch mode {
+	case config.StoragePostgres:
 
-		store, err = storage.NewPostgresStorage(cfg.Username, cfg.Password,
-			cfg.DBPort, cfg.Database)
+		pg, err := storage.NewPostgresStorage(postgresConfig(cfg))
 		if err != nil {
 			log.Error(err.Error())
 			os.Exit(1)
 		}
+		if err = checkSchema(log, pg, autoMigrate, allowPending); err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		pg.SetMaxCommentDepth(cfg.MaxCommentDepth)
+		store = pg
 		log.Info("using postgres")
 
-	} else {
-		store = storage.NewCache()
-		log.Info("using cache")
+		if cfg.ReadCacheTTL > 0 && cfg.ReadCacheSize > 0 {
+			cacheCfg := storage.CachedStorageConfig{TTL: cfg.ReadCacheTTL, MaxEntries: cfg.ReadCacheSize}
+			// Posts read from replicas right after a write may miss it
+			if len(cfg.Replicas) > 0 {
+				cacheCfg.ReplicaLag = cfg.ReplicaLag
+			}
+			store = storage.NewCachedStorage(pg, cacheCfg)
+			log.Info("posts are cached", slog.Duration("ttl", cfg.ReadCacheTTL), slog.Int("size", cfg.ReadCacheSize))
+		}
+
+	case config.StorageSQLite:
+
+		// Migrations of sqlite are applied when the file is opened
+		sqlite, err := storage.NewSQLiteStorage(cfg.SQLitePath)
+		if err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		sqlite.SetMaxCommentDepth(cfg.MaxCommentDepth)
+		store = sqlite
+		log.Info("using sqlite", slog.String("path", cfg.SQLitePath))
+
+	case config.StorageMemory:
+		var cache *storage.Cache
+		if cfg.CacheDir == "" {
+			cache = storage.NewCache()
+			log.Info("using cache")
+		} else {
+			cache, err = storage.NewPersistentCache(storage.PersistenceConfig{
+				Dir:              cfg.CacheDir,
+				Fsync:            storage.FsyncPolicy(cfg.CacheFsync),
+				FsyncInterval:    cfg.CacheFsyncInterval,
+				SnapshotInterval: cfg.CacheSnapshotInterval,
+			})
+			if err != nil {
+				log.Error(err.Error())
+				os.Exit(1)
+			}
+			log.Info("using persistent cache", slog.String("dir", cfg.CacheDir), slog.String("fsync", cfg.CacheFsync))
+		}
+		cache.SetLimits(storage.CacheLimits{MaxEntries: cfg.CacheMaxEntries, MaxBytes: cfg.CacheMaxBytes})
+		cache.SetMaxCommentDepth(cfg.MaxCommentDepth)
+		store = cache
+
+		// Size of the cache and the number of evictions
+		http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(cache.Stats()); err != nil {
+				log.Error(err.Error())
+			}
+		})
+
+	default:
+		log.Error(fmt.Sprintf("unknown storage mode: %q, use %s, %s or %s", mode,
+			config.StorageMemory, config.StoragePostgres, config.StorageSQLite))
+		os.Exit(1)
 	}
 
-	srv := handler.New(graph2.NewExecutableSchema(graph2.Config{Resolvers: &graph2.Resolver{store, log}}))
+	srv := handler.New(graph2.NewExecutableSchema(graph2.Config{Resolvers: &graph2.Resolver{Storage: store, Log: log}}))
 
 	srv.AddTransport(transport.Options{})
 	srv.AddTransport(transport.GET{})
 	srv.AddTransport(transport.POST{})
+	srv.AddTransport(transport.Websocket{
+		KeepAlivePingInterval: keepAlivePingInterval,
+		Upgrader: websocket.Upgrader{
+			CheckOrigin: checkOrigin(cfg.AllowedOrigins),
+		},
+	})
+
+	graph2.AroundOperations(srv, store, cfg.OperationTimeout)
+	srv.SetErrorPresenter(graph2.ErrorPresenter)
 
 	srv.SetQueryCache(lru.New[*ast.QueryDocument](1000))
 
@@ -64,8 +169,113 @@ func main() {
 
 	http.Handle("/query", srv)
 
+	// Server is stopped on interrupt, so the storage can write its state before exit
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	httpServer := &http.Server{Addr: ":" + port}
+	go func() {
+		<-ctx.Done()
+		if err := httpServer.Shutdown(context.Background()); err != nil {
+			log.Error(err.Error())
+		}
+	}()
+
 	log.Info(fmt.Sprintf("connected to http://localhost:%s/", port))
-	log.Error(http.ListenAndServe(":"+port, nil).Error())
+	if err = httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Error(err.Error())
+	}
+
+	if closer, ok := store.(io.Closer); ok {
+		if err = closer.Close(); err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+	}
+	log.Info("server is stopped")
+}
+
+// migrate runs migrate command: up applies pending migrations, down rolls back the last one,
+// status prints the state of every migration
+func migrate(log *slog.Logger, cfg *config.Config, command string) error {
+	if command != "up" && command != "down" && command != "status" {
+		return fmt.Errorf("unknown migrate command: %q, use up, down or status", command)
+	}
+	ctx := context.Background()
+
+	// Migrations are applied to the primary only
+	pgCfg := postgresConfig(cfg)
+	pgCfg.Replicas = nil
+	pg, err := storage.NewPostgresStorage(pgCfg)
+	if err != nil {
+		return err
+	}
+	defer func(pg *storage.PostgresStorage) {
+		_ = pg.Close()
+	}(pg)
+
+	switch command {
+	case "up":
+		versions, err := pg.MigrateUp(ctx)
+		for _, version := range versions {
+			log.Info("migration is applied", slog.Int64("version", version))
+		}
+		if err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			log.Info("there are no pending migrations")
+		}
+	case "down":
+		version, err := pg.MigrateDown(ctx)
+		if err != nil {
+			return err
+		}
+		log.Info("migration is rolled back", slog.Int64("version", version))
+	case "status":
+		statuses, err := pg.MigrationStatuses(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			appliedAt := "Pending"
+			if !status.AppliedAt.IsZero() {
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%-25s %s\n", appliedAt, status.Source.Path)
+		}
+	}
+	return nil
+}
+
+// checkSchema applies pending migrations if autoMigrate is set, and returns error if postgres has
+// a schema version newer than the server knows, or has pending migrations and allowPending isn't set
+func checkSchema(log *slog.Logger, pg *storage.PostgresStorage, autoMigrate, allowPending bool) error {
+	ctx := context.Background()
+
+	current, latest, err := pg.CheckSchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if current == latest {
+		return nil
+	}
+	if !autoMigrate {
+		if !allowPending {
+			return fmt.Errorf("schema version %v is behind %v, run migrate up or start with -autoMigrate",
+				current, latest)
+		}
+		log.Warn("there are pending migrations, run migrate up or start with -autoMigrate",
+			slog.Int64("version", current), slog.Int64("latest", latest))
+		return nil
+	}
+
+	versions, err := pg.MigrateUp(ctx)
+	if err != nil {
+		return err
+	}
+	log.Info("migrations are applied", slog.Int("count", len(versions)), slog.Int64("version", latest))
+	return nil
 }
 
 func NewLogger() *slog.Logger {
@@ -73,3 +283,36 @@ func NewLogger() *slog.Logger {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, opts))
 	return logger
 }
+
+// postgresConfig returns config of PostgresStorage from the storage section of config
+func postgresConfig(cfg *config.Config) storage.PostgresConfig {
+	return storage.PostgresConfig{
+		Username:             cfg.Username,
+		Password:             cfg.Password,
+		Host:                 cfg.DBHost,
+		Port:                 cfg.DBPort,
+		Database:             cfg.Database,
+		MaxConns:             cfg.PoolMaxConns,
+		MaxConnLifetime:      cfg.PoolMaxConnLifetime,
+		Replicas:             cfg.Replicas,
+		ReplicaCheckInterval: cfg.ReplicaCheckInterval,
+	}
+}
+
+// checkOrigin returns CheckOrigin of websocket upgrader that accepts requests from the host of the server
+// and from allowed origins, requests without Origin header don't come from browsers and are accepted
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err == nil && strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		return slices.ContainsFunc(allowed, func(o string) bool {
+			return strings.EqualFold(strings.TrimSuffix(o, "/"), origin)
+		})
+	}
+}